@@ -25,6 +25,41 @@ import (
 	"time"
 )
 
+// A Cache stores the values of a processor instance by key. Implementations
+// must be safe for concurrent use. Select a built-in implementation for a
+// processor using the Policy option or plug in your own using CustomCache.
+type Cache interface {
+	Get(key uint64) (v Value, ok bool)
+	// Returns the values for keys {start..start+size-1}. Stops at the
+	// first key that is not in the cache.
+	GetSlice(start uint64, size int) (sl *Slice)
+	Set(key uint64, value Value)
+	// Sets the values of a slice starting at key start.
+	SetSlice(start uint64, sl *Slice)
+	Delete(key uint64) bool
+	Clear()
+	// Sets the max number of values.
+	SetCapacity(capacity uint64)
+	// Sets the memory limit in bytes, zero means no limit. Sizes are
+	// estimated using sizer, DefaultSizer if nil.
+	SetMaxBytes(maxBytes uint64, sizer Sizer)
+	// Sets the time to live of the values set from now on, zero means no expiration.
+	SetTTL(ttl time.Duration)
+	// Sets the expiration time of a key if it is in the cache.
+	SetExpires(key uint64, expires time.Time)
+	// Sets a function called when a value is evicted to make room. Not
+	// called for values that are deleted or expired. The function must
+	// not call the cache.
+	SetEvict(fn func(it Item))
+	Stats() (length, capacity uint64, oldest time.Time)
+	// Returns the estimated memory used and the limit.
+	Usage() (bytes, maxBytes uint64)
+	Keys() []uint64
+	// Returns the items, the item that would be evicted last first.
+	Items() []Item
+}
+
+// An LRU cache.
 type cache struct {
 	mu sync.Mutex
 
@@ -34,17 +69,29 @@ type cache struct {
 
 	// How many elements we can store in the cache before evicting.
 	capacity uint64
+
+	mem   memory
+	ttl   time.Duration
+	evict func(it Item)
 }
 
-type item struct {
-	Key   uint64
-	Value Value
+// A cached value.
+type Item struct {
+	Key     uint64
+	Value   Value
+	Expires time.Time // zero if the item doesn't expire
 }
 
 type entry struct {
 	key           uint64
 	value         Value
 	time_accessed time.Time
+	size          int       // estimated bytes
+	expires       time.Time // zero if the entry doesn't expire
+}
+
+func (e *entry) item() Item {
+	return Item{Key: e.key, Value: e.value, Expires: e.expires}
 }
 
 func newCache(capacity uint64) *cache {
@@ -55,22 +102,48 @@ func newCache(capacity uint64) *cache {
 	}
 }
 
-func (c *cache) get(key uint64) (v Value, ok bool) {
+func (c *cache) Get(key uint64) (v Value, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.getLocked(key)
+}
+
+func (c *cache) getLocked(key uint64) (v Value, ok bool) {
 	element := c.table[key]
 	if element == nil {
 		return nil, false
 	}
+	if element.Value.(*entry).expired(time.Now()) {
+		c.remove(element)
+		return nil, false
+	}
 	c.moveToFront(element)
 	return element.Value.(*entry).value, true
 }
 
-func (c *cache) getSlice(start uint64, size int) (sl *Slice) {
+// Same as getSlice but takes the lock once.
+func (c *cache) GetSlice(start uint64, size int) (sl *Slice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sl = NewSlice(start, 0, size)
+	for k := 0; k < size; k++ {
+		v, ok := c.getLocked(start + uint64(k))
+		if !ok {
+			break
+		}
+		sl.Data = append(sl.Data, v)
+	}
+	return
+}
+
+// Returns the cached values for keys {start..start+size-1}. Stops at the
+// first key that is not in the cache.
+func getSlice(c Cache, start uint64, size int) (sl *Slice) {
 	sl = NewSlice(start, 0, size)
-	for k, _ := range sl.Data {
-		v, ok := c.get(start + uint64(k))
+	for k := 0; k < size; k++ {
+		v, ok := c.Get(start + uint64(k))
 		if !ok {
 			break
 		}
@@ -79,37 +152,55 @@ func (c *cache) getSlice(start uint64, size int) (sl *Slice) {
 	return
 }
 
-func (c *cache) set(key uint64, value Value) {
+func (c *cache) Set(key uint64, value Value) {
+	size := c.mem.sizeOf(value)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.setLocked(key, value, size)
+}
+
+// Sets a value of the given size, see memory.sizeOf.
+func (c *cache) setLocked(key uint64, value Value, size int) {
 	if element := c.table[key]; element != nil {
-		c.updateInplace(element, value)
+		c.updateInplace(element, value, size)
 	} else {
-		c.addNew(key, value)
+		c.addNew(key, value, size)
 	}
 }
 
-func (c *cache) setSlice(start uint64, sl *Slice) {
+// Same as setSlice but takes the lock once.
+func (c *cache) SetSlice(start uint64, sl *Slice) {
+	sizes := c.mem.sizesOf(sl.Data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range sl.Data {
+		c.setLocked(start+uint64(k), v, sizes[k])
+	}
+}
 
+// Sets the values of a slice starting at key start.
+func setSlice(c Cache, start uint64, sl *Slice) {
 	for k, v := range sl.Data {
 		key := start + uint64(k)
-		c.set(key, v)
+		c.Set(key, v)
 	}
 }
 
 func (c *cache) setIfAbsent(key uint64, value Value) {
+	size := c.mem.sizeOf(value)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if element := c.table[key]; element != nil {
 		c.moveToFront(element)
 	} else {
-		c.addNew(key, value)
+		c.addNew(key, value, size)
 	}
 }
 
-func (c *cache) delete(key uint64) bool {
+func (c *cache) Delete(key uint64) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -117,21 +208,20 @@ func (c *cache) delete(key uint64) bool {
 	if element == nil {
 		return false
 	}
-
-	c.list.Remove(element)
-	delete(c.table, key)
+	c.remove(element)
 	return true
 }
 
-func (c *cache) clear() {
+func (c *cache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.list.Init()
 	c.table = make(map[uint64]*list.Element)
+	c.mem.bytes = 0
 }
 
-func (c *cache) setCapacity(capacity uint64) {
+func (c *cache) SetCapacity(capacity uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -139,7 +229,49 @@ func (c *cache) setCapacity(capacity uint64) {
 	c.checkCapacity()
 }
 
-func (c *cache) stats() (length, capacity uint64, oldest time.Time) {
+func (c *cache) SetMaxBytes(maxBytes uint64, sizer Sizer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*entry, 0, c.list.Len())
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(*entry))
+	}
+	c.mem.set(maxBytes, sizer, entries)
+	c.checkCapacity()
+}
+
+func (c *cache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+func (c *cache) SetExpires(key uint64, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element := c.table[key]; element != nil {
+		element.Value.(*entry).expires = expires
+	}
+}
+
+func (c *cache) SetEvict(fn func(it Item)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict = fn
+}
+
+func (c *cache) Usage() (bytes, maxBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.bytes, c.mem.maxBytes
+}
+
+func (c *cache) Stats() (length, capacity uint64, oldest time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if lastElem := c.list.Back(); lastElem != nil {
@@ -152,11 +284,11 @@ func (c *cache) statsJSON() string {
 	if c == nil {
 		return "{}"
 	}
-	l, cap, o := c.stats()
+	l, cap, o := c.Stats()
 	return fmt.Sprintf("{\"Length\": %v, \"Capacity\": %v, \"OldestAccess\": \"%v\"}", l, cap, o)
 }
 
-func (c *cache) keys() []uint64 {
+func (c *cache) Keys() []uint64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -167,20 +299,33 @@ func (c *cache) keys() []uint64 {
 	return keys
 }
 
-func (c *cache) Items() []item {
+func (c *cache) Items() []Item {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	items := make([]item, 0, c.list.Len())
+	items := make([]Item, 0, c.list.Len())
 	for e := c.list.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*entry)
-		items = append(items, item{Key: v.key, Value: v.value})
+		items = append(items, Item{Key: v.key, Value: v.value, Expires: v.expires})
 	}
 	return items
 }
 
-func (c *cache) updateInplace(element *list.Element, value Value) {
-	element.Value.(*entry).value = value
+// Returns copies of the entries, the most recently used first.
+func (c *cache) entries() []entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]entry, 0, c.list.Len())
+	for e := c.list.Front(); e != nil; e = e.Next() {
+		entries = append(entries, *e.Value.(*entry))
+	}
+	return entries
+}
+
+func (c *cache) updateInplace(element *list.Element, value Value, size int) {
+	c.mem.update(element.Value.(*entry), value, size)
+	element.Value.(*entry).expires = expiration(c.ttl)
 	c.moveToFront(element)
 	c.checkCapacity()
 }
@@ -190,18 +335,27 @@ func (c *cache) moveToFront(element *list.Element) {
 	element.Value.(*entry).time_accessed = time.Now()
 }
 
-func (c *cache) addNew(key uint64, value Value) {
-	newEntry := &entry{key, value, time.Now()}
+func (c *cache) addNew(key uint64, value Value, size int) {
+	newEntry := &entry{key: key, value: value, time_accessed: time.Now(), expires: expiration(c.ttl)}
 	element := c.list.PushFront(newEntry)
 	c.table[key] = element
+	c.mem.add(newEntry, size)
 	c.checkCapacity()
 }
 
 func (c *cache) checkCapacity() {
-	for uint64(c.list.Len()) > c.capacity {
-		delElem := c.list.Back()
-		delValue := delElem.Value.(*entry)
-		c.list.Remove(delElem)
-		delete(c.table, delValue.key)
+	for uint64(c.list.Len()) > c.capacity || (c.mem.over() && c.list.Len() > 0) {
+		e := c.list.Back()
+		c.remove(e)
+		if c.evict != nil {
+			c.evict(e.Value.(*entry).item())
+		}
 	}
 }
+
+func (c *cache) remove(element *list.Element) {
+	e := element.Value.(*entry)
+	c.list.Remove(element)
+	delete(c.table, e.key)
+	c.mem.remove(e)
+}
@@ -13,7 +13,13 @@
 package occult
 
 import (
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type cacheValue struct {
@@ -22,7 +28,7 @@ type cacheValue struct {
 
 func TestInitialState(t *testing.T) {
 	cache := newCache(5)
-	l, c, _ := cache.stats()
+	l, c, _ := cache.Stats()
 	if l != 0 {
 		t.Errorf("length = %v, want 0", l)
 	}
@@ -35,9 +41,9 @@ func TestSetInsertsValue(t *testing.T) {
 	cache := newCache(100)
 	data := &cacheValue{3}
 	key := uint64(100)
-	cache.set(key, data)
+	cache.Set(key, data)
 
-	v, ok := cache.get(key)
+	v, ok := cache.Get(key)
 	if !ok || v.(*cacheValue) != data {
 		t.Errorf("Cache has incorrect value: %v != %v", data, v)
 	}
@@ -47,9 +53,9 @@ func TestGetValueWithMultipleTypes(t *testing.T) {
 	cache := newCache(100)
 	data := &cacheValue{3}
 	key := uint64(100)
-	cache.set(key, data)
+	cache.Set(key, data)
 
-	v, ok := cache.get(uint64(100))
+	v, ok := cache.Get(uint64(100))
 	if !ok || v.(*cacheValue) != data {
 		t.Errorf("Cache has incorrect value for \"key\": %v != %v", data, v)
 	}
@@ -59,11 +65,11 @@ func TestSetWithOldKeyUpdatesValue(t *testing.T) {
 	cache := newCache(100)
 	emptyValue := &cacheValue{3}
 	key := uint64(101)
-	cache.set(key, emptyValue)
+	cache.Set(key, emptyValue)
 	someValue := &cacheValue{20}
-	cache.set(key, someValue)
+	cache.Set(key, someValue)
 
-	v, ok := cache.get(key)
+	v, ok := cache.Get(key)
 	if !ok || v.(*cacheValue) != someValue {
 		t.Errorf("Cache has incorrect value: %v != %v", someValue, v)
 	}
@@ -72,7 +78,7 @@ func TestSetWithOldKeyUpdatesValue(t *testing.T) {
 func TestGetNonExistent(t *testing.T) {
 	cache := newCache(100)
 
-	if _, ok := cache.get(uint64(333)); ok {
+	if _, ok := cache.Get(uint64(333)); ok {
 		t.Error("Cache returned a crap value after no inserts.")
 	}
 }
@@ -82,21 +88,21 @@ func TestDelete(t *testing.T) {
 	value := &cacheValue{1}
 	key := uint64(101)
 
-	if cache.delete(key) {
+	if cache.Delete(key) {
 		t.Error("Item unexpectedly already in cache.")
 	}
 
-	cache.set(key, value)
+	cache.Set(key, value)
 
-	if !cache.delete(key) {
+	if !cache.Delete(key) {
 		t.Error("Expected item to be in cache.")
 	}
 
-	if l, _, _ := cache.stats(); l != 0 {
+	if l, _, _ := cache.Stats(); l != 0 {
 		t.Errorf("length = %v, expected 0", l)
 	}
 
-	if _, ok := cache.get(key); ok {
+	if _, ok := cache.Get(key); ok {
 		t.Error("Cache returned a value after deletion.")
 	}
 }
@@ -106,10 +112,10 @@ func TestClear(t *testing.T) {
 	value := &cacheValue{1}
 	key := uint64(100)
 
-	cache.set(key, value)
-	cache.clear()
+	cache.Set(key, value)
+	cache.Clear()
 
-	if l, _, _ := cache.stats(); l != 0 {
+	if l, _, _ := cache.Stats(); l != 0 {
 		t.Errorf("length = %v, expected 0 after clear()", l)
 	}
 }
@@ -120,15 +126,15 @@ func TestCapacityIsObeyed(t *testing.T) {
 	value := &cacheValue{1}
 
 	// Insert up to the cache's capacity.
-	cache.set(uint64(101), value)
-	cache.set(uint64(102), value)
-	cache.set(uint64(103), value)
-	if l, _, _ := cache.stats(); l != size {
+	cache.Set(uint64(101), value)
+	cache.Set(uint64(102), value)
+	cache.Set(uint64(103), value)
+	if l, _, _ := cache.Stats(); l != size {
 		t.Errorf("cache length = %v, expected %v", l, size)
 	}
 	// Insert one more; something should be evicted to make room.
-	cache.set(uint64(104), value)
-	if l, _, _ := cache.stats(); l != size {
+	cache.Set(uint64(104), value)
+	if l, _, _ := cache.Stats(); l != size {
 		t.Errorf("post-evict cache length = %v, expected %v", l, size)
 	}
 }
@@ -138,22 +144,588 @@ func TestLRUIsEvicted(t *testing.T) {
 	cache := newCache(size)
 	value := &cacheValue{1}
 
-	cache.set(uint64(101), value)
-	cache.set(uint64(102), value)
-	cache.set(uint64(103), value)
+	cache.Set(uint64(101), value)
+	cache.Set(uint64(102), value)
+	cache.Set(uint64(103), value)
 	// lru: [103, 102, 101]
 
 	// Look up the elements. This will rearrange the LRU ordering.
-	cache.get(uint64(103))
-	cache.get(uint64(102))
-	cache.get(uint64(101))
+	cache.Get(uint64(103))
+	cache.Get(uint64(102))
+	cache.Get(uint64(101))
 	// lru: [101, 102, 103]
 
-	cache.set(uint64(100), &cacheValue{1})
+	cache.Set(uint64(100), &cacheValue{1})
 	// lru: [100, 101, 102]
 
 	// The least recently used one should have been evicted.
-	if _, ok := cache.get(uint64(103)); ok {
+	if _, ok := cache.Get(uint64(103)); ok {
 		t.Error("Least recently used element was not evicted.")
 	}
 }
+
+func TestPolicies(t *testing.T) {
+	value := &cacheValue{1}
+
+	// FIFO evicts the oldest even if it was used recently.
+	fifo, _ := newPolicyCache(FIFO, 3)
+	fifo.Set(uint64(101), value)
+	fifo.Set(uint64(102), value)
+	fifo.Set(uint64(103), value)
+	fifo.Get(uint64(101))
+	fifo.Set(uint64(104), value)
+	if _, ok := fifo.Get(uint64(101)); ok {
+		t.Error("FIFO: oldest element was not evicted.")
+	}
+	if keys := fifo.Keys(); !reflect.DeepEqual(keys, []uint64{102, 103, 104}) {
+		t.Errorf("FIFO: keys = %v", keys)
+	}
+	fifo.Delete(uint64(103))
+	fifo.SetCapacity(1)
+	if keys := fifo.Keys(); !reflect.DeepEqual(keys, []uint64{104}) {
+		t.Errorf("FIFO: keys after resize = %v", keys)
+	}
+
+	// LFU evicts the least frequently used.
+	lfu, _ := newPolicyCache(LFU, 3)
+	lfu.Set(uint64(101), value)
+	lfu.Set(uint64(102), value)
+	lfu.Set(uint64(103), value)
+	lfu.Get(uint64(101))
+	lfu.Get(uint64(103))
+	lfu.Set(uint64(104), value)
+	if _, ok := lfu.Get(uint64(102)); ok {
+		t.Error("LFU: least frequently used element was not evicted.")
+	}
+	if l, _, _ := lfu.Stats(); l != 3 {
+		t.Errorf("LFU: length = %v, expected 3", l)
+	}
+
+	// Pinned never evicts.
+	pinned, _ := newPolicyCache(Pinned, 1)
+	pinned.Set(uint64(101), value)
+	pinned.Set(uint64(102), value)
+	if l, _, _ := pinned.Stats(); l != 2 {
+		t.Errorf("pinned: length = %v, expected 2", l)
+	}
+
+	if _, err := newPolicyCache("mru", 1); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestPolicyOptions(t *testing.T) {
+	app := NewApp(&Config{App: &App{
+		Name:     "test",
+		CacheCap: 100,
+		Procs: map[string]*ProcConfig{
+			"agg": {CachePolicy: Pinned},
+			"win": {CachePolicy: FIFO, CacheCap: 10},
+		},
+	}})
+	fn := func(key uint64, ctx *Context) (Value, error) { return key, nil }
+	a := app.AddSource(fn, nil).With(Name("agg"))
+	w := app.AddSource(fn, nil).With(Name("win"), Capacity(20))
+	l := app.AddSource(fn, nil).With(Policy(LFU))
+
+	g := app.Graph()
+	expect(t, g[lookup(a).id].CachePolicy, Pinned)
+	expect(t, g[lookup(a).id].CacheCap, uint64(100))
+	expect(t, g[lookup(w).id].CachePolicy, FIFO)
+	expect(t, g[lookup(w).id].CacheCap, uint64(20))
+	expect(t, g[lookup(l).id].CachePolicy, LFU)
+}
+
+// A Cache implemented outside of the package, never evicts.
+type mapCache struct {
+	mu   sync.Mutex
+	m    map[uint64]Value
+	sets int
+}
+
+func (c *mapCache) Get(key uint64) (Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *mapCache) GetSlice(start uint64, size int) *Slice {
+	sl := NewSlice(start, 0, size)
+	for k := 0; k < size; k++ {
+		v, ok := c.Get(start + uint64(k))
+		if !ok {
+			break
+		}
+		sl.Data = append(sl.Data, v)
+	}
+	return sl
+}
+
+func (c *mapCache) Set(key uint64, value Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = value
+	c.sets++
+}
+
+func (c *mapCache) SetSlice(start uint64, sl *Slice) {
+	for k, v := range sl.Data {
+		c.Set(start+uint64(k), v)
+	}
+}
+
+func (c *mapCache) Delete(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.m[key]
+	delete(c.m, key)
+	return ok
+}
+
+func (c *mapCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[uint64]Value)
+}
+
+func (c *mapCache) SetCapacity(capacity uint64)              {}
+func (c *mapCache) SetMaxBytes(maxBytes uint64, sizer Sizer) {}
+func (c *mapCache) SetTTL(ttl time.Duration)                 {}
+func (c *mapCache) SetExpires(key uint64, expires time.Time) {}
+func (c *mapCache) SetEvict(fn func(it Item))                {}
+
+func (c *mapCache) Stats() (length, capacity uint64, oldest time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return uint64(len(c.m)), 0, time.Time{}
+}
+
+func (c *mapCache) Usage() (bytes, maxBytes uint64) { return 0, 0 }
+
+func (c *mapCache) Keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]uint64, 0, len(c.m))
+	for k := range c.m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (c *mapCache) Items() []Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make([]Item, 0, len(c.m))
+	for k, v := range c.m {
+		items = append(items, Item{Key: k, Value: v})
+	}
+	return items
+}
+
+func TestCustomCache(t *testing.T) {
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+	mc := &mapCache{m: make(map[uint64]Value)}
+	fn := func(key uint64, ctx *Context) (Value, error) { return int(key), nil }
+	p := app.AddSource(fn, nil).With(CustomCache(mc))
+
+	if _, err := p.Map(0, 10); err != nil {
+		t.Fatal(err)
+	}
+	v, err := p(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, v, 3)
+	expect(t, mc.sets, 10)
+	expect(t, lookup(p).Stats().Local, uint64(10))
+	expect(t, app.Graph()[lookup(p).id].CachePolicy, Custom)
+}
+
+// A value that reports its own size.
+type sizedValue int
+
+func (v sizedValue) Size() int { return int(v) }
+
+func TestMemoryLimit(t *testing.T) {
+	for _, policy := range []CachePolicy{LRU, FIFO, LFU} {
+		c, _ := newPolicyCache(policy, 100)
+		c.SetMaxBytes(25, nil)
+		c.Set(uint64(101), sizedValue(10))
+		c.Set(uint64(102), sizedValue(10))
+		if b, _ := c.Usage(); b != 20 {
+			t.Errorf("%s: bytes = %v, expected 20", policy, b)
+		}
+		c.Set(uint64(103), sizedValue(10))
+		if _, ok := c.Get(uint64(101)); ok {
+			t.Errorf("%s: element was not evicted.", policy)
+		}
+		if b, max := c.Usage(); b != 20 || max != 25 {
+			t.Errorf("%s: usage = %v/%v, expected 20/25", policy, b, max)
+		}
+		c.Set(uint64(103), sizedValue(5))
+		c.Delete(uint64(102))
+		if b, _ := c.Usage(); b != 5 {
+			t.Errorf("%s: bytes after delete = %v, expected 5", policy, b)
+		}
+		c.Clear()
+		if b, _ := c.Usage(); b != 0 {
+			t.Errorf("%s: bytes after clear = %v, expected 0", policy, b)
+		}
+	}
+
+	// Pinned reports the memory but never evicts.
+	pinned, _ := newPolicyCache(Pinned, 100)
+	pinned.Set(uint64(101), sizedValue(10))
+	pinned.SetMaxBytes(5, nil)
+	pinned.Set(uint64(102), sizedValue(10))
+	if b, _ := pinned.Usage(); b != 20 {
+		t.Errorf("pinned: bytes = %v, expected 20", b)
+	}
+
+	// Without a limit sizes are not estimated.
+	lru := newCache(100)
+	lru.Set(uint64(101), sizedValue(10))
+	if b, _ := lru.Usage(); b != 0 {
+		t.Errorf("no limit: bytes = %v, expected 0", b)
+	}
+	type point struct {
+		X, Y float64
+		Name string
+	}
+	cases := []struct {
+		v    Value
+		size int
+	}{
+		{[]float64{1, 2, 3}, 24 + 3*8},
+		{"abc", 16 + 3},
+		{point{1, 2, "p"}, 8 + 8 + 16 + 1},
+		{&point{}, 8 + 32},
+		{[]string{"a", "bc"}, 24 + 16 + 1 + 16 + 2},
+	}
+	for _, tc := range cases {
+		if size := DefaultSizer(tc.v); size != tc.size {
+			t.Errorf("size of %#v = %d, expected %d", tc.v, size, tc.size)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	app := NewApp(&Config{App: &App{
+		Name:         "test",
+		CacheCap:     100,
+		MemoryBudget: 1000,
+		Procs: map[string]*ProcConfig{
+			"fixed": {MaxBytes: 400},
+		},
+	}})
+	fn := func(key uint64, ctx *Context) (Value, error) { return sizedValue(10), nil }
+	a := app.AddSource(fn, nil)
+	b := app.AddSource(fn, nil).With(Policy(FIFO))
+	f := app.AddSource(fn, nil).With(Name("fixed"))
+	s := app.AddSource(fn, nil).With(SizeFunc(func(v Value) int { return 100 }))
+
+	stats := app.Stats()
+	expect(t, stats[lookup(a).id].CacheMaxBytes, uint64(200))
+	expect(t, stats[lookup(b).id].CacheMaxBytes, uint64(200))
+	expect(t, stats[lookup(f).id].CacheMaxBytes, uint64(400))
+	expect(t, stats[lookup(s).id].CacheMaxBytes, uint64(200))
+
+	for k := uint64(0); k < 5; k++ {
+		if _, err := s(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats = app.Stats()
+	expect(t, stats[lookup(s).id].CacheLen, uint64(2))
+	expect(t, stats[lookup(s).id].CacheBytes, uint64(200))
+}
+
+func TestCapacityManager(t *testing.T) {
+	app := NewApp(&Config{App: &App{
+		Name:           "test",
+		CacheCap:       100,
+		CapacityBudget: 100,
+	}})
+	fn := func(key uint64, ctx *Context) (Value, error) { return key, nil }
+	hot := app.AddSource(fn, nil)
+	cold := app.AddSource(fn, nil)
+	fixed := app.AddSource(fn, nil).With(Capacity(5))
+	app.splitCapacity()
+
+	if d := app.adjustCapacity(); d != nil {
+		t.Fatalf("unexpected decision with no requests: %+v", d)
+	}
+	for k := uint64(0); k < 200; k++ {
+		hot(k)
+		cold(k % 5)
+		fixed(k)
+	}
+	d := app.adjustCapacity()
+	if d == nil {
+		t.Fatal("expected a decision")
+	}
+	expect(t, d.From, lookup(cold).id)
+	expect(t, d.To, lookup(hot).id)
+	expect(t, d.Amount, uint64(5))
+
+	stats := app.Stats()
+	expect(t, stats[lookup(hot).id].CacheCap, uint64(55))
+	expect(t, stats[lookup(hot).id].CapacityAdded, uint64(5))
+	expect(t, stats[lookup(cold).id].CacheCap, uint64(45))
+	expect(t, stats[lookup(cold).id].CapacityRemoved, uint64(5))
+	expect(t, stats[lookup(fixed).id].CacheCap, uint64(5))
+	expect(t, len(app.CapacityDecisions()), 1)
+}
+
+func TestTTL(t *testing.T) {
+	for _, policy := range []CachePolicy{LRU, FIFO, LFU, Pinned, Sharded} {
+		c, _ := newPolicyCache(policy, 100)
+		c.Set(uint64(101), &cacheValue{1})
+		c.SetTTL(10 * time.Millisecond)
+		c.Set(uint64(102), &cacheValue{2})
+		time.Sleep(20 * time.Millisecond)
+		if _, ok := c.Get(uint64(101)); !ok {
+			t.Errorf("%s: value set without TTL expired", policy)
+		}
+		if _, ok := c.Get(uint64(102)); ok {
+			t.Errorf("%s: value did not expire", policy)
+		}
+		if l, _, _ := c.Stats(); l != 1 {
+			t.Errorf("%s: length = %v, expected 1", policy, l)
+		}
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	c, _ := newPolicyCache(Sharded, 1600)
+	sl := NewSlice(0, 0, 1000)
+	for k := 0; k < 1000; k++ {
+		sl.Data = append(sl.Data, &cacheValue{k})
+	}
+	c.SetSlice(0, sl)
+	if got := c.GetSlice(0, 1000); len(got.Data) != 1000 || got.Data[999].(*cacheValue).x != 999 {
+		t.Fatalf("getSlice returned %d values", len(got.Data))
+	}
+	c.Delete(uint64(500))
+	if got := c.GetSlice(0, 1000); len(got.Data) != 500 {
+		t.Errorf("getSlice returned %d values, expected 500", len(got.Data))
+	}
+	if l, cap, _ := c.Stats(); l != 999 || cap != 1600 {
+		t.Errorf("length, capacity = %v, %v, expected 999, 1600", l, cap)
+	}
+
+	// Each shard keeps the most recent values.
+	c.Get(uint64(999))
+	c.SetCapacity(numShards)
+	if l, _, _ := c.Stats(); l != numShards {
+		t.Errorf("length = %v, expected %v", l, numShards)
+	}
+	if _, ok := c.Get(uint64(999)); !ok {
+		t.Error("most recent value was evicted")
+	}
+
+	// Items are merged from the most recently used.
+	c.Clear()
+	c.SetCapacity(1600)
+	for k := uint64(0); k < 100; k++ {
+		c.Set(k, &cacheValue{int(k)})
+	}
+	time.Sleep(time.Millisecond)
+	c.Get(uint64(5))
+	items := c.Items()
+	expect(t, len(items), 100)
+	expect(t, items[0].Key, uint64(5))
+
+	// Consecutive keys are spread among the shards.
+	used := make(map[int]bool)
+	for k := uint64(0); k < numShards; k++ {
+		used[shardIndex(k)] = true
+	}
+	if len(used) < numShards/2 {
+		t.Errorf("%d consecutive keys use %d shards", numShards, len(used))
+	}
+}
+
+// Many workers setting and getting blocks of values concurrently.
+func benchmarkSlices(b *testing.B, policy CachePolicy) {
+	const size = 10
+	c, _ := newPolicyCache(policy, 10000)
+	var worker uint64
+	b.RunParallel(func(pb *testing.PB) {
+		sl := NewSlice(0, size, size)
+		start := atomic.AddUint64(&worker, 1) * 1000 // each worker uses its own keys
+		for pb.Next() {
+			start = (start + size) % 20000
+			c.SetSlice(start, sl)
+			c.GetSlice(start, size)
+		}
+	})
+}
+
+func BenchmarkLRUSlices(b *testing.B)     { benchmarkSlices(b, LRU) }
+func BenchmarkShardedSlices(b *testing.B) { benchmarkSlices(b, Sharded) }
+
+// Many workers getting single values concurrently.
+func benchmarkGet(b *testing.B, policy CachePolicy) {
+	c, _ := newPolicyCache(policy, 10000)
+	for k := uint64(0); k < 10000; k++ {
+		c.Set(k, &cacheValue{int(k)})
+	}
+	var worker uint64
+	b.RunParallel(func(pb *testing.PB) {
+		key := atomic.AddUint64(&worker, 1) * 1000
+		for pb.Next() {
+			key = (key + 1) % 10000
+			c.Get(key)
+		}
+	})
+}
+
+func BenchmarkLRUGet(b *testing.B)     { benchmarkGet(b, LRU) }
+func BenchmarkShardedGet(b *testing.B) { benchmarkGet(b, Sharded) }
+
+func TestSpill(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 10, SpillDir: dir}})
+	p := app.AddSource(func(key uint64, ctx *Context) (Value, error) {
+		return int(key) * 2, nil
+	}, nil).With(Spill(1<<20), Policy(FIFO))
+
+	for k := uint64(0); k < 30; k++ {
+		if _, err := p(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps := lookup(p).Stats()
+	expect(t, ps.SpillWrites, uint64(20))
+	expect(t, ps.SpillLen, uint64(20))
+
+	v, err := p(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, v, 10)
+	ps = lookup(p).Stats()
+	expect(t, ps.SpillHits, uint64(1))
+	expect(t, ps.Local, uint64(30))
+
+	// Dropping the oldest values when the file is full.
+	d := lookup(p).spill
+	d.maxBytes = d.size
+	d.put(Item{Key: 100, Value: 200})
+	d.flush()
+	if _, ok := d.get(uint64(0)); ok {
+		t.Error("oldest value was not dropped")
+	}
+	if v, ok := d.get(uint64(100)); !ok || v != 200 {
+		t.Errorf("got %v, %v, expected 200", v, ok)
+	}
+	if _, size := d.stats(); size > d.maxBytes {
+		t.Errorf("size = %d, max = %d", size, d.maxBytes)
+	}
+
+	app.Shutdown()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spill file was not removed: %v", files)
+	}
+
+	// The app name is escaped and errors are reported by Validate.
+	app = NewApp(&Config{App: &App{Name: "a/b", CacheCap: 10, SpillDir: dir}})
+	app.AddSource(randomFunc, nil).With(Spill(1 << 20))
+	FatalIf(t, app.Validate())
+	app.Shutdown()
+	app = NewApp(&Config{App: &App{Name: "test", CacheCap: 10, SpillDir: dir + "/missing"}})
+	app.AddSource(randomFunc, nil).With(Spill(1 << 20))
+	if err := app.Validate(); err == nil || !strings.Contains(err.Error(), "can't create spill file") {
+		t.Errorf("expected spill error, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	newApp := func() (*App, Processor) {
+		app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+		ints := app.AddSource(randomFunc, opt, nil).With(Name("ints"), Policy(FIFO))
+		window := app.Add(windowFunc, opt, ints).With(Name("../window"), Policy(Sharded))
+		return app, window
+	}
+
+	app, window := newApp()
+	for k := uint64(0); k < 10; k++ {
+		if _, err := window(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.SaveCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Names are escaped.
+	if _, err := os.Stat(dir + "/..%2Fwindow.cache"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, window2 := newApp()
+	if err := restarted.LoadCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	for id, ps := range app.Stats() {
+		expect(t, restarted.Stats()[id].CacheLen, ps.CacheLen)
+	}
+	for k := uint64(0); k < 10; k++ {
+		v, err := window2(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, _ := window(k)
+		if !reflect.DeepEqual(v, w) {
+			t.Fatalf("value mismatch for key %d", k)
+		}
+	}
+	expect(t, lookup(window2).Stats().Local, uint64(0))
+
+	// A different graph.
+	other, _ := newApp()
+	other.AddSource(randomFunc, opt, nil)
+	err := other.LoadCache(dir)
+	if err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("expected fingerprint error, got %v", err)
+	}
+}
+
+// Values keep their expiration time across a save and load.
+func TestSnapshotTTL(t *testing.T) {
+	dir := t.TempDir()
+	opt := &Options{intSlice: getRandomInts(100)}
+	newApp := func(ttl time.Duration) (*App, Processor) {
+		app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+		return app, app.AddSource(randomFunc, opt, nil).With(TTL(ttl))
+	}
+
+	app, ints := newApp(200 * time.Millisecond)
+	ints.Map(0, 5)
+	time.Sleep(120 * time.Millisecond)
+	ints.Map(5, 10)
+	if err := app.SaveCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Keys 0..4 expired before the load.
+	restarted, ints2 := newApp(time.Hour)
+	if err := restarted.LoadCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	ctx := lookup(ints2)
+	expect(t, ctx.Stats().CacheLen, uint64(5))
+	if _, ok := ctx.cache.Get(5); !ok {
+		t.Fatal("key 5 expired too early")
+	}
+
+	// Keys 5..9 expire at the time set before the save, not in an hour.
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := ctx.cache.Get(5); ok {
+		t.Fatal("key 5 should be expired")
+	}
+}
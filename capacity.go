@@ -0,0 +1,248 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The capacity manager splits App.CapacityBudget among the processor caches
+// and periodically moves capacity from caches that don't use it to caches
+// that would get more hits with more room. Processors with the pinned policy
+// or with their own capacity (see Capacity) are not managed.
+
+const (
+	// Seconds between capacity adjustments.
+	DefaultCapacityPeriod = 10
+	// Max number of decisions kept by the manager.
+	numCapacityDecisions = 100
+	// Fraction of the budget moved in one adjustment.
+	capacityStep = 0.05
+	// A managed cache never gets less than this fraction of an equal share.
+	capacityMinShare = 0.25
+)
+
+// A capacity change made by the capacity manager.
+type CapacityDecision struct {
+	Time time.Time
+	// Ids of the processors that lost and gained capacity.
+	From, To int
+	Amount   uint64
+	// Hits per item of capacity of the donor and misses per item of
+	// capacity of the receiver during the last period.
+	Loss, Gain float64
+}
+
+type capManager struct {
+	sync.Mutex
+	// Counters at the last adjustment, indexed by processor id.
+	last      map[int]capSample
+	decisions []CapacityDecision
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type capSample struct {
+	hits, misses uint64
+}
+
+func newCapManager() *capManager {
+	return &capManager{
+		last: make(map[int]capSample),
+		stop: make(chan struct{}),
+	}
+}
+
+// Splits the budget and starts adjusting capacities in the background.
+// Does nothing if there is no budget.
+func (app *App) startCapacityManager() {
+	if app.CapacityBudget == 0 {
+		return
+	}
+	app.splitCapacity()
+	period := time.Duration(app.CapacityPeriod) * time.Second
+	glog.Infof("capacity manager started, budget: %d, period: %s", app.CapacityBudget, period)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				app.adjustCapacity()
+			case <-app.capManager.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the capacity manager.
+func (app *App) stopCapacityManager() {
+	m := app.capManager
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// Returns the managed processors in ascending id order.
+func (app *App) managedProcs() []*Context {
+	var procs []*Context
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		if ctx.fixedCap || ctx.policy == Pinned {
+			continue
+		}
+		procs = append(procs, ctx)
+	}
+	return procs
+}
+
+// Splits App.CapacityBudget equally among the managed processors.
+func (app *App) splitCapacity() {
+	procs := app.managedProcs()
+	if len(procs) == 0 {
+		return
+	}
+	share := app.CapacityBudget / uint64(len(procs))
+	if share == 0 {
+		share = 1
+	}
+	for _, ctx := range procs {
+		ctx.cache.SetCapacity(share)
+		ctx.flushSpill()
+	}
+}
+
+// Moves capacity from the processor that benefits the least from its cache
+// to the processor with the most misses on a full cache. Returns the
+// decision or nil if nothing changed.
+func (app *App) adjustCapacity() *CapacityDecision {
+
+	m := app.capManager
+	m.Lock()
+	defer m.Unlock()
+
+	type sample struct {
+		ctx                      *Context
+		hits, misses             uint64
+		length, capacity, unused uint64
+	}
+	procs := app.managedProcs()
+	samples := make([]sample, 0, len(procs))
+	for _, ctx := range procs {
+		cur := capSample{
+			hits:   atomic.LoadUint64(&ctx.stats.numCacheHits),
+			misses: atomic.LoadUint64(&ctx.stats.numCacheMisses),
+		}
+		prev := m.last[ctx.id]
+		m.last[ctx.id] = cur
+		s := sample{ctx: ctx, hits: cur.hits - prev.hits, misses: cur.misses - prev.misses}
+		s.length, s.capacity, _ = ctx.cache.Stats()
+		if s.length < s.capacity {
+			s.unused = s.capacity - s.length
+		}
+		samples = append(samples, s)
+	}
+	if len(samples) < 2 {
+		return nil
+	}
+	minCap := uint64(capacityMinShare * float64(app.CapacityBudget) / float64(len(samples)))
+	if minCap == 0 {
+		minCap = 1
+	}
+	step := uint64(capacityStep * float64(app.CapacityBudget))
+	if step == 0 {
+		step = 1
+	}
+	perItem := func(n, capacity uint64) float64 {
+		if capacity == 0 {
+			return float64(n)
+		}
+		return float64(n) / float64(capacity)
+	}
+
+	// The receiver is full and had misses, more room would turn some into hits.
+	to := -1
+	for i, s := range samples {
+		if s.unused > 0 || s.misses == 0 {
+			continue
+		}
+		if to < 0 || perItem(s.misses, s.capacity) > perItem(samples[to].misses, samples[to].capacity) {
+			to = i
+		}
+	}
+	if to < 0 {
+		return nil
+	}
+
+	// The donor has unused capacity or the fewest hits per item.
+	from := -1
+	loss := func(s sample) float64 {
+		if s.unused > 0 {
+			return 0
+		}
+		return perItem(s.hits, s.capacity)
+	}
+	for i, s := range samples {
+		if i == to || s.capacity <= minCap {
+			continue
+		}
+		if from < 0 || loss(s) < loss(samples[from]) ||
+			(loss(s) == loss(samples[from]) && s.unused > samples[from].unused) {
+			from = i
+		}
+	}
+	if from < 0 {
+		return nil
+	}
+	gain := perItem(samples[to].misses, samples[to].capacity)
+	if gain <= loss(samples[from]) {
+		return nil
+	}
+
+	amount := step
+	if max := samples[from].capacity - minCap; amount > max {
+		amount = max
+	}
+	if u := samples[from].unused; u > 0 && amount > u {
+		amount = u // only take what is not used
+	}
+	src, dst := samples[from].ctx, samples[to].ctx
+	src.cache.SetCapacity(samples[from].capacity - amount)
+	dst.cache.SetCapacity(samples[to].capacity + amount)
+	src.flushSpill()
+	atomic.AddUint64(&src.stats.numCapRemoved, amount)
+	atomic.AddUint64(&dst.stats.numCapAdded, amount)
+
+	d := CapacityDecision{
+		Time:   time.Now(),
+		From:   src.id,
+		To:     dst.id,
+		Amount: amount,
+		Loss:   loss(samples[from]),
+		Gain:   gain,
+	}
+	glog.Infof("moved cache capacity %d from proc %d (%.3f hits/item) to proc %d (%.3f misses/item)",
+		amount, d.From, d.Loss, d.To, d.Gain)
+	m.decisions = append(m.decisions, d)
+	if len(m.decisions) > numCapacityDecisions {
+		m.decisions = m.decisions[len(m.decisions)-numCapacityDecisions:]
+	}
+	return &d
+}
+
+// Returns the most recent decisions of the capacity manager, oldest first.
+func (app *App) CapacityDecisions() []CapacityDecision {
+	m := app.capManager
+	m.Lock()
+	defer m.Unlock()
+
+	decisions := make([]CapacityDecision, len(m.decisions))
+	copy(decisions, m.decisions)
+	return decisions
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Time Dial waits for an in-process server to start serving.
+const chanDialTimeout = 5 * time.Second
+
+// Returned by calls to an in-process server that was closed.
+var errChanClosed = errors.New("in-process server is closed")
+
+// In-process servers indexed by address.
+var chanServers = struct {
+	sync.Mutex
+	cond *sync.Cond
+	m    map[string]*chanServer
+}{m: make(map[string]*chanServer)}
+
+func init() {
+	chanServers.cond = sync.NewCond(&chanServers.Mutex)
+}
+
+// Sends the requests to an App running in the same process using channels.
+// The address is only a name that identifies the App. Values are passed by
+// reference without encoding so processors must not modify the values
+// they return. There are no status pages.
+type chanTransport struct {
+	addr string
+	srv  *chanServer
+}
+
+// Runs the requests sent to an address.
+type chanServer struct {
+	reqs chan *chanRequest
+	done chan struct{}
+}
+
+// A request runs fn on the server and sends the error to reply.
+type chanRequest struct {
+	fn    func(rp *RProc) error
+	reply chan error
+}
+
+func (t *chanTransport) Serve(addr string, rp *RProc) error {
+	chanServers.Lock()
+	defer chanServers.Unlock()
+	if _, ok := chanServers.m[addr]; ok {
+		return fmt.Errorf("address %s is in use", addr)
+	}
+	srv := &chanServer{
+		reqs: make(chan *chanRequest),
+		done: make(chan struct{}),
+	}
+	go srv.run(rp)
+	t.addr, t.srv = addr, srv
+	chanServers.m[addr] = srv
+	chanServers.cond.Broadcast()
+	return nil
+}
+
+func (srv *chanServer) run(rp *RProc) {
+	for {
+		select {
+		case req := <-srv.reqs:
+			go func() { req.reply <- req.fn(rp) }()
+		case <-srv.done:
+			return
+		}
+	}
+}
+
+// Waits up to chanDialTimeout for a server on addr.
+func (t *chanTransport) Dial(addr string) (Conn, error) {
+	timer := time.AfterFunc(chanDialTimeout, func() {
+		chanServers.Lock()
+		chanServers.cond.Broadcast()
+		chanServers.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(chanDialTimeout)
+
+	chanServers.Lock()
+	defer chanServers.Unlock()
+	for {
+		if srv, ok := chanServers.m[addr]; ok {
+			return &chanConn{srv}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("dialing error: no in-process server on %s", addr)
+		}
+		chanServers.cond.Wait()
+	}
+}
+
+func (t *chanTransport) Close() error {
+	if t.srv == nil {
+		return nil
+	}
+	chanServers.Lock()
+	defer chanServers.Unlock()
+	if chanServers.m[t.addr] == t.srv {
+		delete(chanServers.m, t.addr)
+	}
+	close(t.srv.done)
+	t.srv = nil
+	return nil
+}
+
+type chanConn struct {
+	srv *chanServer
+}
+
+// Sends fn to the server and waits for the result. Errors returned
+// by fn are *RemoteError.
+func (c *chanConn) do(fn func(rp *RProc) error) error {
+	req := &chanRequest{fn: fn, reply: make(chan error, 1)}
+	select {
+	case c.srv.reqs <- req:
+	case <-c.srv.done:
+		return errChanClosed
+	}
+	if err := <-req.reply; err != nil {
+		return &RemoteError{Msg: err.Error()}
+	}
+	return nil
+}
+
+func (c *chanConn) Get(args *RArgs) (*RSlice, error) {
+	var reply RSlice
+	if err := c.do(func(rp *RProc) error { return rp.Get(args, &reply) }); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (c *chanConn) GetMulti(args *RMultiArgs) (*RMultiReply, error) {
+	var reply RMultiReply
+	if err := c.do(func(rp *RProc) error { return rp.GetMulti(args, &reply) }); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// The values are not encoded.
+func (c *chanConn) Negotiate(offer *Encoding) (*Encoding, error) {
+	return nil, nil
+}
+
+func (c *chanConn) Ready() (ready bool, err error) {
+	err = c.do(func(rp *RProc) error { return rp.Ready(0, &ready) })
+	return
+}
+
+func (c *chanConn) Fingerprint() (fp string, err error) {
+	err = c.do(func(rp *RProc) error { return rp.Fingerprint(0, &fp) })
+	return
+}
+
+func (c *chanConn) Invalidate(args *RArgs) error {
+	var reply bool
+	return c.do(func(rp *RProc) error { return rp.Invalidate(args, &reply) })
+}
+
+func (c *chanConn) Shutdown() error {
+	var reply bool
+	return c.do(func(rp *RProc) error { return rp.Shutdown(0, &reply) })
+}
+
+func (c *chanConn) Close() error {
+	return nil
+}
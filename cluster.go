@@ -1,11 +1,62 @@
 package occult
 
-import "net/rpc"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 type Node struct {
-	ID       int    `yaml:"id"`
-	Addr     string `yaml:"addr"`
-	rpClient *rpc.Client
+	ID   int    `yaml:"id"`
+	Addr string `yaml:"addr"`
+	// Guards conn and encoding after Run and the health fields.
+	mu   sync.Mutex
+	conn Conn
+	// Encoding negotiated with the node, nil if none.
+	encoding *Encoding
+	// Set by the failure detector.
+	state    NodeState
+	lastSeen time.Time
+	misses   int
+	// Slots for the calls in flight to the node.
+	inflight chan struct{}
+}
+
+// Returns the connection to the node and its encoding.
+func (node *Node) connection() (Conn, *Encoding) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.conn, node.encoding
+}
+
+// Replaces the connection to the node. Returns the old connection.
+func (node *Node) setConnection(conn Conn, enc *Encoding) Conn {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	old := node.conn
+	node.conn, node.encoding = conn, enc
+	return old
+}
+
+// Waits for a slot to send a call to the node. Returns
+// the context error if c is done first.
+func (node *Node) acquire(c context.Context) error {
+	if node.inflight == nil {
+		return nil
+	}
+	select {
+	case node.inflight <- struct{}{}:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// Frees the slot taken by acquire.
+func (node *Node) release() {
+	if node.inflight != nil {
+		<-node.inflight
+	}
 }
 
 type Cluster struct {
@@ -14,6 +65,9 @@ type Cluster struct {
 	Nodes []*Node `yaml:"nodes"`
 	// The local node ID.
 	NodeID int
+	// Carries the requests between nodes, empty means DefaultTransport.
+	// (See Transport.)
+	Transport string `yaml:"transport"`
 }
 
 // Returns true if node id is the local node.
@@ -0,0 +1,269 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// By default, the values sent to other nodes are encoded by the transport,
+// GOB for the rpc transport. A processor can use a codec instead, for
+// example to send numeric arrays in a compact form. Encoded values larger
+// than App.CompressThreshold bytes are compressed using App.Compression.
+// The codecs and the compression are negotiated when a node connects to
+// another node so nodes with different settings can talk to each other.
+
+// Encodes the values of a slice for the wire.
+type Codec interface {
+	Name() string
+	Encode(values []Value) ([]byte, error)
+	// Decodes n values. The type of the values is typ for typed
+	// processors, nil otherwise.
+	Decode(data []byte, n int, typ reflect.Type) ([]Value, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	"gob":     gobCodec{},
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+	"raw":     rawCodec{},
+}}
+
+// Makes a codec available by name. Nodes only use the codecs
+// registered on both sides of a connection.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.Name()] = c
+}
+
+// Returns the codec registered with name.
+func LookupCodec(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[name]
+	return c, ok
+}
+
+// Returns the names of the registered codecs in order.
+func codecNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	names := make([]string, 0, len(codecs.m))
+	for name := range codecs.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sets the codec used to send the processor values to other nodes.
+// Panics if the codec is not registered. (See RegisterCodec.)
+func WireCodec(name string) ProcOption {
+	return func(ctx *Context) {
+		c, ok := LookupCodec(name)
+		if !ok {
+			panic(fmt.Sprintf("occult: unknown codec %q, available: %v", name, codecNames()))
+		}
+		ctx.codec = c
+	}
+}
+
+// Returns the codec set with WireCodec, nil if the values are sent as is.
+func (ctx *Context) Codec() Codec {
+	return ctx.codec
+}
+
+// The wire encoding of a connection. The client offers the codecs it can
+// decode and the server keeps the ones it knows. Payloads larger than
+// Threshold bytes are compressed using Compression, empty for none.
+type Encoding struct {
+	Codecs      []string
+	Compression string
+	Threshold   int
+}
+
+// Returns true if the codec was negotiated.
+func (enc *Encoding) accepts(name string) bool {
+	for _, n := range enc.Codecs {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The encoding offered by this node when it connects to another node.
+func (app *App) encodingOffer() *Encoding {
+	return &Encoding{
+		Codecs:      codecNames(),
+		Compression: app.Compression,
+		Threshold:   app.CompressThreshold,
+	}
+}
+
+// Returns the part of an offer supported by this node.
+func negotiate(offer *Encoding) *Encoding {
+	enc := &Encoding{Threshold: offer.Threshold}
+	for _, name := range offer.Codecs {
+		if _, ok := LookupCodec(name); ok {
+			enc.Codecs = append(enc.Codecs, name)
+		}
+	}
+	if _, ok := compressors[offer.Compression]; ok {
+		enc.Compression = offer.Compression
+	}
+	return enc
+}
+
+// A slice on the wire. The values are in Data unless they were
+// encoded with a codec, then they are in Payload.
+type RSlice struct {
+	Offset      uint64
+	Data        []Value
+	Length      int
+	Codec       string
+	Compression string
+	Payload     []byte
+}
+
+// Prepares a slice of processor ctx to be sent using enc. Processors
+// without a codec use gob if the payload may be compressed.
+func encodeSlice(ctx *Context, sl *Slice, enc *Encoding) (RSlice, error) {
+
+	rs := RSlice{Offset: sl.Offset, Length: len(sl.Data)}
+	codec := ctx.codec
+	if codec == nil && enc != nil && enc.Compression != "" {
+		codec = gobCodec{}
+	}
+	if enc == nil || codec == nil || !enc.accepts(codec.Name()) {
+		rs.Data = sl.Data
+		return rs, nil
+	}
+	payload, err := codec.Encode(sl.Data)
+	if err != nil {
+		return rs, fmt.Errorf("codec %s: %w", codec.Name(), err)
+	}
+	rs.Codec = codec.Name()
+	if enc.Compression != "" && len(payload) > enc.Threshold {
+		if payload, err = compress(enc.Compression, payload); err != nil {
+			return rs, err
+		}
+		rs.Compression = enc.Compression
+	}
+	rs.Payload = payload
+	return rs, nil
+}
+
+// Returns the values of a slice received from another node. ctx is the
+// local instance of the processor, nil if unknown.
+func decodeSlice(ctx *Context, rs *RSlice) (*Slice, error) {
+
+	if rs.Codec == "" {
+		return &Slice{Offset: rs.Offset, Data: rs.Data}, nil
+	}
+	data := rs.Payload
+	if rs.Compression != "" {
+		var err error
+		if data, err = decompress(rs.Compression, data); err != nil {
+			return nil, err
+		}
+	}
+	codec, ok := LookupCodec(rs.Codec)
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", rs.Codec)
+	}
+	var typ reflect.Type
+	if ctx != nil {
+		typ = ctx.outType
+	}
+	values, err := codec.Decode(data, rs.Length, typ)
+	if err != nil {
+		return nil, fmt.Errorf("codec %s: %w", rs.Codec, err)
+	}
+	if len(values) != rs.Length {
+		return nil, fmt.Errorf("codec %s: got %d values, expected %d", rs.Codec, len(values), rs.Length)
+	}
+	return &Slice{Offset: rs.Offset, Data: values}, nil
+}
+
+// Encodes values with GOB. Custom types must be registered. (See gob.Register.)
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Encode(values []Value) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, n int, typ reflect.Type) ([]Value, error) {
+	values := make([]Value, 0, n)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values)
+	return values, err
+}
+
+// Encodes values with JSON. Values of untyped processors are decoded
+// as generic JSON values, numbers become float64.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(values []Value) ([]byte, error) {
+	return json.Marshal(values)
+}
+
+func (jsonCodec) Decode(data []byte, n int, typ reflect.Type) ([]Value, error) {
+	return decodeTyped(data, n, typ, json.Unmarshal)
+}
+
+// Encodes values with MessagePack. Values of untyped processors are
+// decoded as generic values, for example int64 for integers.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Encode(values []Value) ([]byte, error) {
+	return msgpack.Marshal(values)
+}
+
+func (msgpackCodec) Decode(data []byte, n int, typ reflect.Type) ([]Value, error) {
+	return decodeTyped(data, n, typ, msgpack.Unmarshal)
+}
+
+// Decodes a list of values into a slice of typ so the values
+// have the type of the processor.
+func decodeTyped(data []byte, n int, typ reflect.Type, unmarshal func([]byte, any) error) ([]Value, error) {
+	if typ == nil {
+		values := make([]Value, 0, n)
+		err := unmarshal(data, &values)
+		return values, err
+	}
+	sp := reflect.New(reflect.SliceOf(typ))
+	if err := unmarshal(data, sp.Interface()); err != nil {
+		return nil, err
+	}
+	s := sp.Elem()
+	values := make([]Value, s.Len())
+	for i := range values {
+		values[i] = s.Index(i).Interface()
+	}
+	return values, nil
+}
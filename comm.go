@@ -1,11 +1,10 @@
 package occult
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"net"
-	"net/http"
-	"net/rpc"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -15,74 +14,183 @@ import (
 // for indices between start and end for processor instance running on remote node.
 
 // Executes remote synchronous call to target remote process on target node. Returns value.
-func (app *App) rpCall(key uint64, procID int, node *Node) (Value, error) {
-	slice, err := app.rpCallSlice(key, key+1, procID, node)
-	if slice.Data == nil {
-		glog.Error(err)
+func (app *App) rpCall(c context.Context, key uint64, procID int, node *Node) (Value, error) {
+	slice, err := app.rpCallSlice(c, key, key+1, procID, node)
+	if err != nil {
 		return nil, err
 	}
-	return slice.Data[0], err
+	if slice.Length() == 0 {
+		return nil, ErrEndOfArray
+	}
+	return slice.Data[0], nil
 }
 
 // Executes remote synchronous call to target remote process on target node. Returns slice.
-func (app *App) rpCallSlice(start, end uint64, procID int, node *Node) (result *Slice, err error) {
-	args := &RArgs{Start: start, End: end, ProcID: procID}
-	var reply Slice
-	err = node.rpClient.Call("RProc.Get", args, &reply)
+// The call returns early if c is done. The deadline of c, if any, is sent to the
+// remote node as a timeout. The slice is shorter than the range if the end of the
+// array was reached. Returns a *NodeError if the node can't be reached. (See callNode.)
+func (app *App) rpCallSlice(c context.Context, start, end uint64, procID int, node *Node) (result *Slice, err error) {
+	var reply *RSlice
+	err = app.callNode(c, node, func(c context.Context) (err error) {
+		conn, enc := node.connection()
+		args := &RArgs{Start: start, End: end, ProcID: procID, Encoding: enc}
+		if args.Timeout, err = timeout(c); err != nil {
+			return err
+		}
+		var r *RSlice
+		err = rpGo(c, node, func() (err error) {
+			r, err = conn.Get(args)
+			return
+		})
+		if err == nil {
+			reply = r
+		}
+		return err
+	})
 	if err != nil {
 		glog.Error(err)
 		return nil, err
 	}
-	result = &reply
-	return result, nil
+	return decodeSlice(app.procs[procID], reply)
+}
+
+// Requests several ranges to a node in a single call. The ranges are computed
+// in parallel by the remote node. Returns a slice and an error for each range,
+// err is not nil if the call failed.
+func (app *App) rpCallMulti(c context.Context, node *Node, ranges []RArgs) (slices []*Slice, errs []error, err error) {
+	var reply *RMultiReply
+	err = app.callNode(c, node, func(c context.Context) (err error) {
+		conn, enc := node.connection()
+		args := &RMultiArgs{Ranges: ranges, Encoding: enc}
+		if args.Timeout, err = timeout(c); err != nil {
+			return err
+		}
+		var r *RMultiReply
+		err = rpGo(c, node, func() (err error) {
+			r, err = conn.GetMulti(args)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if expired(c) {
+			// Ranges may have failed because the remote node timed out too.
+			for _, e := range r.Errs {
+				if e != "" {
+					return context.DeadlineExceeded
+				}
+			}
+		}
+		reply = r
+		return nil
+	})
+	if err != nil {
+		glog.Error(err)
+		return nil, nil, err
+	}
+	if len(reply.Slices) != len(ranges) {
+		return nil, nil, fmt.Errorf("got %d slices from node %d, expected %d", len(reply.Slices), node.ID, len(ranges))
+	}
+	slices = make([]*Slice, len(ranges))
+	errs = make([]error, len(ranges))
+	for i, r := range ranges {
+		if reply.Errs[i] != "" {
+			errs[i] = errors.New(reply.Errs[i])
+			continue
+		}
+		slices[i], errs[i] = decodeSlice(app.procs[r.ProcID], &reply.Slices[i])
+	}
+	return slices, errs, nil
+}
+
+// Returns the time left before c is done, zero if there is no deadline.
+// We send a duration instead of a deadline to avoid clock skew between nodes.
+func timeout(c context.Context) (time.Duration, error) {
+	d, ok := c.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	if t := time.Until(d); t > 0 {
+		return t, nil
+	}
+	return 0, context.DeadlineExceeded
+}
+
+// Runs a remote call in a goroutine and waits for it to finish. Waits for a
+// free slot if there are too many calls in flight to the node. Returns early
+// if c is done, the slot is released when the call returns. The results set by
+// call must not be used if rpGo returns early.
+//
+// Calls made while serving a remote request don't take a slot: the node
+// that sent the request holds a slot until we reply and may be waiting for
+// a slot to call us back.
+func rpGo(c context.Context, node *Node, call func() error) error {
+	serving := isServing(c)
+	if !serving {
+		if err := node.acquire(c); err != nil {
+			return err
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := call()
+		if !serving {
+			node.release()
+		}
+		done <- err
+	}()
+	select {
+	case <-c.Done():
+		// The remote node keeps working until its timeout expires, the reply is discarded.
+		return c.Err()
+	case err := <-done:
+		return err
+	}
 }
 
+// Max time between checks in rpIsReady.
+const readyPollInterval = 2 * time.Second
+
 // Check if remote server is ready.
 func rpIsReady(node *Node, ch chan bool) {
 
-	args := 0
-	var ready bool
-	for !ready {
+	wait := 10 * time.Millisecond
+	for {
 		glog.Infof("checking if server %s is ready", node.Addr)
-		err := node.rpClient.Call("RProc.Ready", args, &ready)
+		conn, _ := node.connection()
+		ready, err := conn.Ready()
 		if err != nil {
 			glog.Infof("waiting for server ready: %s", err)
 		}
-		time.Sleep(2 * time.Second)
+		if ready {
+			break
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > readyPollInterval {
+			wait = readyPollInterval
+		}
 	}
 	close(ch)
 }
 
-func rpShutdown(node *Node) {
-	args := 0
-	var reply bool
-	err := node.rpClient.Call("RProc.Shutdown", args, &reply)
-	if err != nil {
-		glog.Infof("shutdown for node %s failed with error: %s", node.ID, err)
-	}
+// Returns the graph fingerprint of a remote node.
+func rpFingerprint(node *Node) (string, error) {
+	conn, _ := node.connection()
+	return conn.Fingerprint()
 }
 
-// Starts the remote process server.
-func (app *App) rpServe(addr string) {
-	rp := &RProc{
-		app: app,
-	}
-	rpc.Register(rp)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", addr)
-	if e != nil {
-		log.Fatalf("listen error: %s", e)
-	}
-	http.Serve(l, nil)
+// Invalidates keys on a remote node. (See App.Invalidate.)
+func rpInvalidate(node *Node, procID int, start, end uint64) error {
+	conn, _ := node.connection()
+	return conn.Invalidate(&RArgs{Start: start, End: end, ProcID: procID})
 }
 
-// Returns client for target server address.
-func rpClient(addr string) (client *rpc.Client, err error) {
-	client, err = rpc.DialHTTP("tcp", addr)
+func rpShutdown(node *Node) {
+	conn, _ := node.connection()
+	err := conn.Shutdown()
 	if err != nil {
-		return nil, fmt.Errorf("dialing error: %s", err)
+		glog.Infof("shutdown for node %d failed with error: %s", node.ID, err)
 	}
-	return
 }
 
 // Below are the low-level functions to handle inter-process communication.
@@ -93,6 +201,26 @@ func rpClient(addr string) (client *rpc.Client, err error) {
 type RArgs struct {
 	Start, End uint64
 	ProcID     int
+	// Time left before the caller gives up. Zero means no timeout.
+	// We send a duration instead of a deadline to avoid clock skew between nodes.
+	Timeout time.Duration
+	// Encoding negotiated for the connection, nil to send the values as is.
+	Encoding *Encoding
+}
+
+// Arguments to request several ranges in one call. The timeout
+// of each range is ignored.
+type RMultiArgs struct {
+	Ranges   []RArgs
+	Timeout  time.Duration
+	Encoding *Encoding
+}
+
+// Reply to a multi-range request. Errs[i] is the error for
+// range i, empty if the range succeeded.
+type RMultiReply struct {
+	Slices []RSlice
+	Errs   []string
 }
 
 // Returned type for RPC method.
@@ -101,44 +229,142 @@ type RArgs struct {
 // here we can have metadata sent by remote server.
 //}
 
-// RPC type to get remote values.
+// Serves the requests from remote nodes. A Transport calls its methods
+// which have the signature required by net/rpc.
 type RProc struct {
 	app *App
 }
 
-// RPC method to get remote values.
-func (rp *RProc) Get(args *RArgs, rv *Slice) error {
+// RPC method to get remote values. The keys are computed in parallel.
+// The slice is shorter than the range if the end of the array is reached.
+// The values are encoded as negotiated. (See Codec.)
+func (rp *RProc) Get(args *RArgs, rv *RSlice) error {
 
-	n := int(args.End - args.Start)
-	//rv = NewSlice(args.Start, 0, n)
-	rv.Offset = args.Start
-	rv.Data = make([]Value, 0, n)
+	c, cancel := timeoutContext(args.Timeout)
+	defer cancel()
 
-	ctx := rp.app.Context(args.ProcID)
-	p := ctx.proc
-	idx := args.Start
-	for ; idx < args.End; idx++ {
-		val, err := p(uint64(idx))
-		if err != nil {
-			glog.Error(err)
-			return fmt.Errorf("rpc error: %s", err)
+	sl, err := rp.app.GetRange(c, args.ProcID, args.Start, args.End)
+	if err != nil {
+		glog.Error(err)
+		return fmt.Errorf("rpc error: %s", err)
+	}
+	if *rv, err = encodeSlice(rp.app.procs[args.ProcID], sl, args.Encoding); err != nil {
+		glog.Error(err)
+		return fmt.Errorf("rpc error: %s", err)
+	}
+	return nil
+}
+
+// RPC method to get several ranges of remote values. The
+// ranges are computed in parallel.
+func (rp *RProc) GetMulti(args *RMultiArgs, reply *RMultiReply) error {
+
+	c, cancel := timeoutContext(args.Timeout)
+	defer cancel()
+
+	n := len(args.Ranges)
+	reply.Slices = make([]RSlice, n)
+	reply.Errs = make([]string, n)
+	var wg sync.WaitGroup
+	for i, r := range args.Ranges {
+		wg.Add(1)
+		go func(i int, r RArgs) {
+			defer wg.Done()
+			sl, err := rp.app.GetRange(c, r.ProcID, r.Start, r.End)
+			if err != nil {
+				glog.Error(err)
+				reply.Slices[i].Offset = r.Start
+				reply.Errs[i] = err.Error()
+				return
+			}
+			if reply.Slices[i], err = encodeSlice(rp.app.procs[r.ProcID], sl, args.Encoding); err != nil {
+				glog.Error(err)
+				reply.Errs[i] = err.Error()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Marks the contexts used to serve remote requests.
+type servingKey struct{}
+
+// Returns a context with the timeout sent by the caller.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	c := context.WithValue(context.Background(), servingKey{}, true)
+	if timeout > 0 {
+		return context.WithTimeout(c, timeout)
+	}
+	return context.WithCancel(c)
+}
+
+// Returns true if c is used to serve a remote request.
+func isServing(c context.Context) bool {
+	return c.Value(servingKey{}) != nil
+}
+
+// Computes the values of processor procID for keys in [start,end) in
+// parallel. The slice is truncated at the end of the array. Used to
+// serve remote requests.
+func (app *App) GetRange(c context.Context, procID int, start, end uint64) (*Slice, error) {
+	ctx, ok := app.procs[procID]
+	if !ok {
+		return nil, fmt.Errorf("no processor with id %d", procID)
+	}
+	if end < start {
+		return nil, fmt.Errorf("invalid key range [%d,%d)", start, end)
+	}
+	values := make([]Value, end-start)
+	done := make([]bool, end-start)
+	err := app.mapRange(c, ctx, start, values, done)
+	if kerr, ok := err.(*KeyError); ok && kerr.Err == ErrEndOfArray {
+		values, err = values[:kerr.Key-start], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The caller caches the slice, don't send holes.
+	for k := range values {
+		if !done[k] {
+			return nil, fmt.Errorf("no value for key %d of proc %d", start+uint64(k), procID)
 		}
-		rv.Data = append(rv.Data, val)
 	}
+	return &Slice{Offset: start, Data: values}, nil
+}
+
+// Agrees on the encoding of the values sent to a client. Returns the
+// codecs and compression offered by the client that this node supports.
+func (rp *RProc) Negotiate(offer *Encoding, enc *Encoding) error {
+	*enc = *negotiate(offer)
 	return nil
 }
 
 // Tells client if server is ready to start takign requests.
 func (rp *RProc) Ready(args int, ready *bool) error {
 
-	if rp.app.ready {
-		*ready = true
+	*ready = rp.app.Ready()
+	return nil
+}
+
+// Returns the graph fingerprint of this node.
+func (rp *RProc) Fingerprint(args int, fp *string) error {
+	*fp = rp.app.Fingerprint()
+	return nil
+}
+
+// Invalidates keys on this node. Downstream caches are cleared.
+func (rp *RProc) Invalidate(args *RArgs, ok *bool) error {
+	if err := rp.app.invalidate(args.ProcID, args.Start, args.End); err != nil {
+		return err
 	}
+	*ok = true
 	return nil
 }
 
+// Terminates this node if it runs in server mode. (See App.Terminate.)
 func (rp *RProc) Shutdown(args int, ready *bool) error {
 
-	rp.app.terminate <- true
+	rp.app.Terminate()
 	return nil
 }
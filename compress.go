@@ -0,0 +1,71 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Default size in bytes above which payloads are compressed.
+const DefaultCompressThreshold = 1024
+
+// Compression algorithms for the payloads sent to other nodes. (See
+// App.Compression.) Snappy is faster, zstd compresses more.
+var compressors = map[string]struct {
+	compress   func(b []byte) ([]byte, error)
+	decompress func(b []byte) ([]byte, error)
+}{
+	"snappy": {
+		compress:   func(b []byte) ([]byte, error) { return snappy.Encode(nil, b), nil },
+		decompress: func(b []byte) ([]byte, error) { return snappy.Decode(nil, b) },
+	},
+	"zstd": {
+		compress: func(b []byte) ([]byte, error) {
+			enc, _ := zstdCoders()
+			return enc.EncodeAll(b, nil), nil
+		},
+		decompress: func(b []byte) ([]byte, error) {
+			_, dec := zstdCoders()
+			return dec.DecodeAll(b, nil)
+		},
+	},
+}
+
+var zstdOnce struct {
+	sync.Once
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// Returns the zstd encoder and decoder shared by all the connections,
+// both are safe for concurrent use.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdOnce.enc, _ = zstd.NewWriter(nil)
+		zstdOnce.dec, _ = zstd.NewReader(nil)
+	})
+	return zstdOnce.enc, zstdOnce.dec
+}
+
+func compress(alg string, b []byte) ([]byte, error) {
+	c, ok := compressors[alg]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", alg)
+	}
+	return c.compress(b)
+}
+
+func decompress(alg string, b []byte) ([]byte, error) {
+	c, ok := compressors[alg]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", alg)
+	}
+	return c.decompress(b)
+}
@@ -13,7 +13,16 @@ Configuration file. Example:
    app:
      name: "myapp"
      cache_cap: 1000
+     cache_policy: lru
+     memory_budget: 67108864
+     compression: snappy
+     capacity_budget: 10000
+     procs:
+       window:
+         cache_policy: fifo
+         codec: raw
    cluster:
+     transport: rpc
      nodes:
        - id: 0
        - addr: ":33330"
@@ -8,6 +8,7 @@ package main
 // Evaluate various collaborative filtering algorithms using a test set.
 
 import (
+	"context"
 	"math"
 
 	"github.com/akualab/occult"
@@ -27,10 +28,18 @@ type EvalOptions struct {
 	cf         *CF
 	db         *store.Store
 	globalMean float64
-	sqErr      *SqErr
 	alpha      float64
 }
 
+// Adds the squared errors in q to s.
+func (s *SqErr) Add(q *SqErr) {
+	s.n += q.n
+	s.globalMean += q.globalMean
+	s.weightedUserMean += q.weightedUserMean
+	s.weightedItemMean += q.weightedItemMean
+	s.mf += q.mf
+}
+
 func EvalCF(dbTest string, config *occult.Config, cf *CF) {
 	db, err := store.NewStore(dbTest)
 	fatalIf(err)
@@ -40,34 +49,28 @@ func EvalCF(dbTest string, config *occult.Config, cf *CF) {
 		db:         db,
 		cf:         cf,
 		globalMean: cf.GlobalMean(),
-		sqErr:      &SqErr{},
 	}
 
 	app := occult.NewApp(config)
 	evalProc := app.AddSource(evalFunc, opt, nil)
 
-	var i uint64
-	for {
-		v, e := evalProc(i)
-		if e != nil && e != occult.ErrEndOfArray {
-			glog.Fatal(e)
-		}
-		if v != nil {
-			glog.V(5).Infof("chunk[%4d]: %v", i, v)
-		}
-		if e == occult.ErrEndOfArray {
-			glog.V(3).Infof("end of array found at index %d", i)
-			break
-		}
-		i++
+	sqErr := &SqErr{}
+	it := evalProc.Iterator(context.Background(), 0, 0)
+	for it.Next() {
+		glog.V(5).Infof("obs[%4d]: %v", it.Key(), it.Value())
+		sqErr.Add(it.Value().(*SqErr))
+	}
+	if err := it.Err(); err != nil {
+		glog.Fatal(err)
 	}
+	glog.V(3).Infof("end of array found at index %d", it.NextKey())
 
-	n := float64(opt.sqErr.n)
+	n := float64(sqErr.n)
 	glog.Infof("N:%.0f, alpha:%.2f", n, cf.alpha)
-	glog.Infof("%20s: %.4f", "Global Mean", math.Sqrt(opt.sqErr.globalMean/n))
-	glog.Infof("%20s: %.4f", "Adj. User Mean", math.Sqrt(opt.sqErr.weightedUserMean/n))
-	glog.Infof("%20s: %.4f", "Item Mean", math.Sqrt(opt.sqErr.weightedItemMean/n))
-	glog.Infof("%20s: %.4f", "Simple MF", math.Sqrt(opt.sqErr.mf/n))
+	glog.Infof("%20s: %.4f", "Global Mean", math.Sqrt(sqErr.globalMean/n))
+	glog.Infof("%20s: %.4f", "Adj. User Mean", math.Sqrt(sqErr.weightedUserMean/n))
+	glog.Infof("%20s: %.4f", "Item Mean", math.Sqrt(sqErr.weightedItemMean/n))
+	glog.Infof("%20s: %.4f", "Simple MF", math.Sqrt(sqErr.mf/n))
 }
 
 func evalFunc(idx uint64, ctx *occult.Context) (occult.Value, error) {
@@ -79,19 +82,19 @@ func evalFunc(idx uint64, ctx *occult.Context) (occult.Value, error) {
 	}
 	obs := v.(Obs)
 	glog.V(7).Infof("U:%d, I:%d, R:%d, Mean%.2f", obs.User, obs.Item, obs.Rating, opt.globalMean)
-	opt.sqErr.n += 1
+	sqErr := &SqErr{n: 1}
 
 	// Global Mean
 	diff := float64(obs.Rating) - opt.globalMean
-	opt.sqErr.globalMean += diff * diff
+	sqErr.globalMean = diff * diff
 
 	// Weighted User Mean
 	diff = float64(obs.Rating) - opt.cf.WeightedUserMean(obs.User)
-	opt.sqErr.weightedUserMean += diff * diff
+	sqErr.weightedUserMean = diff * diff
 
 	// Weighted Item Mean
 	diff = float64(obs.Rating) - opt.cf.WeightedItemMean(obs.Item)
-	opt.sqErr.weightedItemMean += diff * diff
+	sqErr.weightedItemMean = diff * diff
 
 	// Matrix Factorization
 	rhat, e := opt.cf.MFPredict(obs.User, obs.Item)
@@ -101,7 +104,7 @@ func evalFunc(idx uint64, ctx *occult.Context) (occult.Value, error) {
 		glog.V(2).Infof("backing off prediction, %s", e)
 	}
 	diff = float64(obs.Rating) - rhat
-	opt.sqErr.mf += diff * diff
+	sqErr.mf = diff * diff
 
-	return nil, nil
+	return sqErr, nil
 }
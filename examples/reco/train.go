@@ -8,6 +8,7 @@ package main
 // Train various collaborative filtering algorithms using a training set.
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"runtime"
@@ -87,18 +88,18 @@ func aggCFFunc(idx uint64, ctx *occult.Context) (occult.Value, error) {
 		return nil, occult.ErrEndOfArray
 	}
 	cf := NewCF(opt.alpha)
-	ch := ctx.Inputs()[0].MapAll(0, ctx)
-	for {
-		v, ok := <-ch
-		if !ok {
-			if glog.V(5) {
-				glog.Infof("aggCFFunc returning idx:%d, NumRatingsx:%#v", idx, cf.NumRatings)
-			}
-			return cf, nil
-		}
-		q := v.(*CF)
+	s := ctx.Inputs()[0].StreamUnordered(context.Background(), 0, occult.NoEnd)
+	for pair := range s.C {
+		q := pair.Value.(*CF)
 		cf.Reduce(q)
 	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if glog.V(5) {
+		glog.Infof("aggCFFunc returning idx:%d, NumRatingsx:%#v", idx, cf.NumRatings)
+	}
+	return cf, nil
 }
 
 // Matrix factorization.
@@ -155,11 +156,11 @@ func TrainCF(dbName string, config *occult.Config, chunkSize int) *CF {
 	}
 
 	app := occult.NewApp(config)
-	dataChunk := app.AddSource(movieFunc, opt, nil)
-	cfProc := app.Add(cfFunc, opt, dataChunk)
-	aggCFProc := app.Add(aggCFFunc, opt, cfProc)
+	dataChunk := app.AddSource(movieFunc, opt, nil).With(occult.Name("chunks"))
+	cfProc := app.Add(cfFunc, opt, dataChunk).With(occult.Name("cf"))
+	aggCFProc := app.Add(aggCFFunc, opt, cfProc).With(occult.Name("agg-cf"), occult.Policy(occult.Pinned))
 
-	mfProc := app.Add(mfFunc, opt, dataChunk, aggCFProc)
+	mfProc := app.Add(mfFunc, opt, dataChunk, aggCFProc).With(occult.Name("mf"))
 
 	// If server, stays here forever, otherwise keep going.
 	app.Run()
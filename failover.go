@@ -0,0 +1,100 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Any node can do any work so a request to a node that can't be reached
+// is retried a few times, then the node is marked as suspect in the router
+// and the work is sent to another node or done locally. A node that is
+// reachable but slow is not suspect, the call returns an error.
+
+// Returned by a Conn when the remote node handled the call and failed.
+// Other errors mean the node could not be reached.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Msg
+}
+
+// Returned when a node could not be reached after all the retries.
+type NodeError struct {
+	Node int
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node %d is unreachable: %s", e.Node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// Returns true if err means that a node is unreachable.
+func isNodeError(err error) bool {
+	var ne *NodeError
+	return errors.As(err, &ne)
+}
+
+// Calls a remote node. The call is cancelled after App.CallTimeout.
+// If the node can't be reached, the call is retried up to App.CallRetries
+// times, waiting App.RetryBackoff between attempts and doubling the wait
+// each time. Then the node is marked as suspect for App.SuspectPeriod
+// seconds and a *NodeError is returned. Errors returned by the remote
+// node, timeouts and cancellation of c are not retried. A node that times
+// out may just be busy, the failure detector finds the nodes that are down.
+func (app *App) callNode(c context.Context, node *Node, call func(c context.Context) error) error {
+
+	timeout := time.Duration(app.CallTimeout) * time.Millisecond
+	wait := time.Duration(app.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		tc, cancel := context.WithTimeout(c, timeout)
+		err := call(tc)
+		cancel()
+		if err == nil || c.Err() != nil {
+			return err
+		}
+		if expired(tc) {
+			// The remote node may give up at the same time, its
+			// error means that the call timed out too.
+			return fmt.Errorf("call to node %d timed out after %s: %w", node.ID, timeout, context.DeadlineExceeded)
+		}
+		var re *RemoteError
+		if errors.As(err, &re) {
+			return err
+		}
+		if attempt >= app.CallRetries {
+			until := time.Now().Add(time.Duration(app.SuspectPeriod) * time.Second)
+			app.router.Suspect(node.ID, until)
+			glog.Warningf("node %d is unreachable, suspect until %s: %s", node.ID, until.Format(time.TimeOnly), err)
+			return &NodeError{Node: node.ID, Err: err}
+		}
+		glog.V(1).Infof("call to node %d failed, retrying in %s: %s", node.ID, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-c.Done():
+			return c.Err()
+		}
+		wait *= 2
+	}
+}
+
+// Returns true if the deadline of c has passed. The error of c
+// may not be set yet.
+func expired(c context.Context) bool {
+	d, ok := c.Deadline()
+	return ok && !time.Now().Before(d)
+}
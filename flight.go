@@ -0,0 +1,92 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A flight coalesces concurrent calls for the same key. While a call
+// for a key is in flight, other callers for the same key wait for its
+// result instead of doing the work again. (Similar to groupcache's singleflight.)
+type flight struct {
+	mu    sync.Mutex
+	calls map[uint64]*flightCall
+
+	numCalls     uint64 // calls that did the work
+	numCoalesced uint64 // calls that waited for another call
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  Value
+	err  error
+}
+
+func newFlight() *flight {
+	return &flight{calls: make(map[uint64]*flightCall)}
+}
+
+// Executes fn for key making sure only one call for key is in flight
+// at a time. Duplicate callers wait for the original call to finish
+// and receive the same results. A caller stops waiting when c is done.
+// If the original call fails because its own context was cancelled,
+// waiting callers whose context is still alive try again. A panic in
+// fn is returned as an error.
+func (f *flight) do(c context.Context, key uint64, fn func() (Value, error)) (Value, error) {
+	for {
+		f.mu.Lock()
+		if call, ok := f.calls[key]; ok {
+			f.mu.Unlock()
+			atomic.AddUint64(&f.numCoalesced, 1)
+			select {
+			case <-call.done:
+			case <-c.Done():
+				return nil, c.Err()
+			}
+			if isContextErr(call.err) && c.Err() == nil {
+				continue
+			}
+			return call.val, call.err
+		}
+		call := &flightCall{done: make(chan struct{})}
+		f.calls[key] = call
+		f.mu.Unlock()
+		atomic.AddUint64(&f.numCalls, 1)
+
+		f.call(key, call, fn)
+		return call.val, call.err
+	}
+}
+
+// Runs fn for a call in flight. The call is removed and the waiting
+// callers are released even if fn panics, the panic is returned as an
+// error to all the callers.
+func (f *flight) call(key uint64, call *flightCall, fn func() (Value, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.val, call.err = nil, fmt.Errorf("panic computing key %d: %v", key, r)
+		}
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+		close(call.done)
+	}()
+	call.val, call.err = fn()
+}
+
+// Returns the number of calls that did the work and the number of
+// calls that were coalesced.
+func (f *flight) counts() (calls, coalesced uint64) {
+	return atomic.LoadUint64(&f.numCalls), atomic.LoadUint64(&f.numCoalesced)
+}
+
+func isContextErr(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// A ProcOption configures a processor instance.
+type ProcOption func(ctx *Context)
+
+// Applies options to the processor and returns the processor. Must be
+// called before running the app. Example:
+//
+//	chunks := app.AddSource(movieFunc, opt).With(occult.Name("chunks"))
+func (p Processor) With(opts ...ProcOption) Processor {
+	ctx := lookup(p)
+	if ctx == nil {
+		panic("occult: options can only be applied to processors created by an App")
+	}
+	for _, opt := range opts {
+		opt(ctx)
+	}
+	return p
+}
+
+// Same as Processor.With for typed processors.
+func (p TypedProcessor[T]) With(opts ...ProcOption) TypedProcessor[T] {
+	p.Processor.With(opts...)
+	return p
+}
+
+// Gives the processor a name. Names must be unique within an app.
+// If the configuration file has settings for the name, they are
+// applied. Options that follow Name override them.
+func Name(name string) ProcOption {
+	return func(ctx *Context) {
+		if other, ok := ctx.app.names[name]; ok && other != ctx {
+			panic(fmt.Sprintf("occult: processor name %q already used by processor %d", name, other.id))
+		}
+		delete(ctx.app.names, ctx.name)
+		ctx.name = name
+		ctx.app.names[name] = ctx
+
+		// Apply the settings from the configuration file.
+		if pc, ok := ctx.app.Procs[name]; ok {
+			for _, opt := range pc.options() {
+				opt(ctx)
+			}
+		}
+	}
+}
+
+// The name of the processor. Empty if the processor has no name.
+func (ctx *Context) Name() string {
+	return ctx.name
+}
+
+// The id of the processor.
+func (ctx *Context) ID() int {
+	return ctx.id
+}
+
+// Returns the processor with the given name, nil if not found.
+func (app *App) Proc(name string) Processor {
+	if ctx, ok := app.names[name]; ok {
+		return ctx.proc
+	}
+	return nil
+}
+
+// Returns the id of the processor with the given name, -1 if not found.
+func (app *App) ProcID(name string) int {
+	if ctx, ok := app.names[name]; ok {
+		return ctx.id
+	}
+	return -1
+}
+
+// Describes a processor instance in the app graph.
+type ProcInfo struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Name of the function that implements the processor.
+	Func string `json:"func"`
+	// Ids of the input processors. Inputs that were not created
+	// by an App have id -1.
+	Inputs []int `json:"inputs"`
+	Source bool  `json:"source"`
+	// The type of the Options field.
+	Options string `json:"options,omitempty"`
+	// The type of the values for typed processors.
+	Type        string      `json:"type,omitempty"`
+	CachePolicy CachePolicy `json:"cache_policy,omitempty"`
+	CacheCap    uint64      `json:"cache_cap"`
+	// Live cache stats, only set when requested.
+	Stats *GraphStats `json:"stats,omitempty"`
+}
+
+// Cache stats used to annotate the graph.
+type GraphStats struct {
+	Requests uint64  `json:"requests"`
+	HitRate  float64 `json:"hit_rate"`
+	CacheLen uint64  `json:"cache_len"`
+}
+
+// Returns the processor graph ordered by id.
+func (app *App) Graph() []ProcInfo {
+	g := make([]ProcInfo, 0, len(app.procs))
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		info := ProcInfo{
+			ID:     id,
+			Name:   ctx.name,
+			Func:   ctx.funcName,
+			Inputs: ctx.inputIDs(),
+			Source: ctx.isSource,
+
+			CachePolicy: ctx.policy,
+		}
+		_, info.CacheCap, _ = ctx.cache.Stats()
+		if ctx.Options != nil {
+			info.Options = reflect.TypeOf(ctx.Options).String()
+		}
+		if ctx.outType != nil {
+			info.Type = ctx.outType.String()
+		}
+		g = append(g, info)
+	}
+	return g
+}
+
+// Returns a hash of the processor graph. Nodes in a cluster must
+// have the same fingerprint to work together.
+func (app *App) Fingerprint() string {
+	h := sha1.New()
+	for _, info := range app.Graph() {
+		fmt.Fprintf(h, "%d|%s|%s|%v|%t|%s|%s\n", info.ID, info.Name, info.Func, info.Inputs,
+			info.Source, info.Options, info.Type)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the graph annotated with live cache stats.
+func (app *App) graphWithStats() []ProcInfo {
+	g := app.Graph()
+	for i := range g {
+		ps := app.procs[g[i].ID].Stats()
+		g[i].Stats = &GraphStats{
+			Requests: ps.Requests,
+			HitRate:  ps.HitRate(),
+			CacheLen: ps.CacheLen,
+		}
+	}
+	return g
+}
+
+// Writes the processor graph as JSON. If withStats is true, the
+// processors are annotated with live cache stats.
+func (app *App) WriteJSON(w io.Writer, withStats bool) error {
+	g := app.Graph()
+	if withStats {
+		g = app.graphWithStats()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Name        string     `json:"name"`
+		Fingerprint string     `json:"fingerprint"`
+		Procs       []ProcInfo `json:"procs"`
+	}{app.Name, app.Fingerprint(), g})
+}
+
+// Writes the processor graph in the Graphviz DOT language. Sources are
+// drawn as cylinders and edges go from inputs to processors. If withStats
+// is true, the processors are annotated with live cache stats. To render:
+//
+//	dot -Tpng graph.dot > graph.png
+func (app *App) WriteDOT(w io.Writer, withStats bool) error {
+	g := app.Graph()
+	if withStats {
+		g = app.graphWithStats()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", app.Name)
+	b.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+	for _, info := range g {
+		label := fmt.Sprintf("%d", info.ID)
+		if info.Name != "" {
+			label += ": " + info.Name
+		}
+		label += "\n" + info.Func + fmt.Sprintf("\ncap: %d", info.CacheCap)
+		if info.CachePolicy != "" {
+			label += fmt.Sprintf(" (%s)", info.CachePolicy)
+		}
+		if info.Stats != nil {
+			label += fmt.Sprintf("\nlen: %d, hits: %.1f%%", info.Stats.CacheLen, 100*info.Stats.HitRate)
+		}
+		attrs := ""
+		if info.Source {
+			attrs = ", shape=cylinder"
+		}
+		fmt.Fprintf(&b, "  p%d [label=%q%s];\n", info.ID, label, attrs)
+		for k, in := range info.Inputs {
+			if in < 0 {
+				// Not created by the app.
+				fmt.Fprintf(&b, "  ext%d_%d [label=\"external\", style=dashed];\n", info.ID, k)
+				fmt.Fprintf(&b, "  ext%d_%d -> p%d;\n", info.ID, k, info.ID)
+				continue
+			}
+			fmt.Fprintf(&b, "  p%d -> p%d;\n", in, info.ID)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Validate checks the processor graph. It rejects inputs created by another
+// App, nil inputs on processors that are not sources, sources with inputs,
+// and options that failed (such as Spill). Nil inputs on sources are ignored.
+// Inputs not created by an App are external, they are called as is. Cycles
+// are rejected too. Validate is called by Run.
+func (app *App) Validate() error {
+
+	var errs []error
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		for _, err := range ctx.optErrs {
+			errs = append(errs, fmt.Errorf("processor %s: %w", ctx, err))
+		}
+		for k, in := range ctx.inputs {
+			ic := ctx.inputCtxs[k]
+			switch {
+			case in == nil && ctx.isSource:
+			case in == nil:
+				errs = append(errs, fmt.Errorf("processor %s: input %d is nil", ctx, k))
+			case ctx.isSource:
+				errs = append(errs, fmt.Errorf("processor %s: source processors can't have inputs", ctx))
+			case ic != nil && ic.app != app:
+				errs = append(errs, fmt.Errorf("processor %s: input %d belongs to app %q", ctx, k, ic.app.Name))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return app.checkCycles()
+}
+
+// Returns an error describing the first cycle found in the graph.
+func (app *App) checkCycles() error {
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[int]int, len(app.procs))
+	var path []int
+	var visit func(ctx *Context) error
+	visit = func(ctx *Context) error {
+		switch state[ctx.id] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := []string{ctx.String()}
+			for i := len(path) - 1; i >= 0 && path[i] != ctx.id; i-- {
+				cycle = append(cycle, app.procs[path[i]].String())
+			}
+			cycle = append(cycle, ctx.String())
+			// Path was collected backwards, reverse it so it follows the edges.
+			for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+				cycle[i], cycle[j] = cycle[j], cycle[i]
+			}
+			return fmt.Errorf("cycle in processor graph: %s", strings.Join(cycle, " <- "))
+		}
+		state[ctx.id] = visiting
+		path = append(path, ctx.id)
+		for _, ic := range ctx.inputCtxs {
+			if ic != nil && ic.app == app {
+				if err := visit(ic); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[ctx.id] = visited
+		return nil
+	}
+	for _, id := range app.procIDs() {
+		if err := visit(app.procs[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Identifies the processor in messages using its id and name.
+func (ctx *Context) String() string {
+	if ctx.name != "" {
+		return fmt.Sprintf("%d (%s)", ctx.id, ctx.name)
+	}
+	return fmt.Sprintf("%d", ctx.id)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package grpcsvc serves the values of an occult app over gRPC so clients
+written in any language can read them. The service is described in
+occult.proto. The values are encoded with the codec set for the
+processor with occult.WireCodec, JSON if none.
+
+To serve on its own port:
+
+	app.Add(features, nil, input).With(occult.WireCodec("msgpack"))
+	svc := grpcsvc.New(app)
+	go svc.Serve(":33400")
+
+Or register the service on an existing server created with
+grpc.NewServer(grpcsvc.ServerOption()).
+*/
+package grpcsvc
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/akualab/occult"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Implements the Occult gRPC service for an app.
+type Service struct {
+	app           *occult.App
+	allowShutdown bool
+}
+
+// Configures a Service.
+type Option func(s *Service)
+
+// Serves the Shutdown method which lets any client terminate the node.
+// Only use it on a trusted network.
+func AllowShutdown() Option {
+	return func(s *Service) {
+		s.allowShutdown = true
+	}
+}
+
+// Creates a service for app. Shutdown is not served unless
+// AllowShutdown is used.
+func New(app *occult.App, opts ...Option) *Service {
+	s := &Service{app: app}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Returns the server option needed to run the service. Messages of
+// other services are still encoded with proto.
+func ServerOption() grpc.ServerOption {
+	return grpc.ForceServerCodec(wireCodec{})
+}
+
+// Registers the service on a server created with ServerOption.
+func (s *Service) Register(srv *grpc.Server) {
+	desc := serviceDesc
+	if s.allowShutdown {
+		desc.Methods = append([]grpc.MethodDesc{shutdownMethod}, desc.Methods...)
+	}
+	srv.RegisterService(&desc, s)
+}
+
+// Serves the service on addr. Blocks until the listener fails.
+func (s *Service) Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(ServerOption())
+	s.Register(srv)
+	glog.Infof("grpc service started on address %s", addr)
+	return srv.Serve(l)
+}
+
+func (s *Service) get(c context.Context, req *GetRequest) (*GetReply, error) {
+
+	id := int(req.ProcID)
+	if req.ProcName != "" {
+		if id = s.app.ProcID(req.ProcName); id < 0 {
+			return nil, status.Errorf(codes.NotFound, "no processor named %q", req.ProcName)
+		}
+	}
+	if s.app.Context(id) == nil {
+		return nil, status.Errorf(codes.NotFound, "no processor with id %d", id)
+	}
+	if req.End < req.Start {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid key range [%d,%d)", req.Start, req.End)
+	}
+	sl, err := s.app.GetRange(c, id, req.Start, req.End)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, status.FromContextError(err).Err()
+		}
+		return nil, status.Error(codes.Unknown, err.Error())
+	}
+	codec := s.app.Context(id).Codec()
+	if codec == nil {
+		codec, _ = occult.LookupCodec("json")
+	}
+	data, err := codec.Encode(sl.Data)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can't encode values with codec %s: %s", codec.Name(), err)
+	}
+	reply := &GetReply{
+		Offset: sl.Offset,
+		Codec:  codec.Name(),
+		Length: uint64(len(sl.Data)),
+		Data:   data,
+	}
+	return reply, nil
+}
+
+func (s *Service) ready(c context.Context, req *ReadyRequest) (*ReadyReply, error) {
+	return &ReadyReply{Ready: s.app.Ready()}, nil
+}
+
+func (s *Service) shutdown(c context.Context, req *ShutdownRequest) (*ShutdownReply, error) {
+	s.app.Terminate()
+	return &ShutdownReply{}, nil
+}
+
+// Used by RegisterService to check the type of the service.
+type occultServer interface {
+	get(context.Context, *GetRequest) (*GetReply, error)
+	ready(context.Context, *ReadyRequest) (*ReadyReply, error)
+	shutdown(context.Context, *ShutdownRequest) (*ShutdownReply, error)
+}
+
+// Returns a gRPC method handler that decodes a Req and calls fn.
+func handler[Req any, Reply any](method string, fn func(*Service, context.Context, *Req) (*Reply, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv any, c context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*Service)
+			if interceptor == nil {
+				return fn(s, c, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/occult.Occult/" + method}
+			return interceptor(c, req, info, func(c context.Context, req any) (any, error) {
+				return fn(s, c, req.(*Req))
+			})
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "occult.Occult",
+	HandlerType: (*occultServer)(nil),
+	Methods: []grpc.MethodDesc{
+		handler("Get", (*Service).get),
+		handler("Ready", (*Service).ready),
+	},
+	Metadata: "occult.proto",
+}
+
+// Added by Register with AllowShutdown.
+var shutdownMethod = handler("Shutdown", (*Service).shutdown)
@@ -0,0 +1,133 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grpcsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/akualab/occult"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type hexCodec struct{}
+
+func (hexCodec) Name() string { return "hex" }
+
+func (hexCodec) Encode(values []occult.Value) ([]byte, error) {
+	return []byte(fmt.Sprintf("%x", values)), nil
+}
+
+func (hexCodec) Decode(data []byte, n int, typ reflect.Type) ([]occult.Value, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestService(t *testing.T) {
+
+	app := occult.NewApp(&occult.Config{App: &occult.App{Name: "test", CacheCap: 100}})
+	squares := app.AddSource(func(key uint64, ctx *occult.Context) (occult.Value, error) {
+		if key >= 20 {
+			return nil, occult.ErrEndOfArray
+		}
+		return int(key * key), nil
+	}, nil)
+	squares.With(occult.Name("squares"))
+	occult.RegisterCodec(hexCodec{})
+	app.AddSource(func(key uint64, ctx *occult.Context) (occult.Value, error) {
+		return int(key), nil
+	}, nil).With(occult.WireCodec("hex"))
+	conn := dial(t, New(app))
+	c := context.Background()
+
+	// By name, truncated at the end of the array.
+	var reply GetReply
+	if err := conn.Invoke(c, "/occult.Occult/Get", &GetRequest{ProcName: "squares", Start: 15, End: 25}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Offset != 15 || reply.Codec != "json" || reply.Length != 5 {
+		t.Fatalf("got offset %d, codec %s, %d values", reply.Offset, reply.Codec, reply.Length)
+	}
+	var v []int
+	if err := json.Unmarshal(reply.Data, &v); err != nil || len(v) != 5 || v[4] != 19*19 {
+		t.Fatalf("got %v, %v, expected %d last", v, err, 19*19)
+	}
+
+	// By id with the codec of the processor.
+	reply = GetReply{}
+	if err := conn.Invoke(c, "/occult.Occult/Get", &GetRequest{ProcID: 1, Start: 30, End: 32}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Codec != "hex" || reply.Length != 2 || string(reply.Data) != "[1e 1f]" {
+		t.Fatalf("got codec %s, values %q", reply.Codec, reply.Data)
+	}
+
+	err := conn.Invoke(c, "/occult.Occult/Get", &GetRequest{ProcName: "cubes", End: 1}, &reply)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	err = conn.Invoke(c, "/occult.Occult/Get", &GetRequest{ProcID: 0, Start: 5, End: 1}, &reply)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	var ready ReadyReply
+	if err := conn.Invoke(c, "/occult.Occult/Ready", &ReadyRequest{}, &ready); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients can't terminate the node unless allowed.
+	err = conn.Invoke(c, "/occult.Occult/Shutdown", &ShutdownRequest{}, &ShutdownReply{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+	conn = dial(t, New(app, AllowShutdown()))
+	if err := conn.Invoke(c, "/occult.Occult/Shutdown", &ShutdownRequest{}, &ShutdownReply{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serves svc in memory and returns a client connection.
+func dial(t *testing.T, svc *Service) *grpc.ClientConn {
+	l := bufconn.Listen(1 << 16)
+	srv := grpc.NewServer(ServerOption())
+	svc.Register(srv)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(c context.Context, _ string) (net.Conn, error) { return l.DialContext(c) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMessages(t *testing.T) {
+
+	req := &GetRequest{ProcID: -3, Start: 1 << 40, End: 1<<40 + 7}
+	var got GetRequest
+	if err := got.unmarshal(req.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if got != *req {
+		t.Fatalf("got %+v, expected %+v", got, *req)
+	}
+	if err := got.unmarshal([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Fatal("expected error for truncated message")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grpcsvc
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// The messages in occult.proto, encoded by hand with protowire so the
+// package doesn't need generated code. Keep the field numbers in sync
+// with the proto file.
+
+// Request for the values of a processor. The processor is selected by
+// ProcName if not empty, by ProcID otherwise.
+type GetRequest struct {
+	ProcID     int32
+	ProcName   string
+	Start, End uint64
+}
+
+// The values for keys {Offset..Offset+Length-1} encoded together with Codec.
+type GetReply struct {
+	Offset uint64
+	Codec  string
+	Length uint64
+	Data   []byte
+}
+
+type ReadyRequest struct{}
+
+type ReadyReply struct {
+	Ready bool
+}
+
+type ShutdownRequest struct{}
+
+type ShutdownReply struct{}
+
+// Implemented by the messages of this package.
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+func (m *GetRequest) marshal() (b []byte) {
+	if m.ProcName != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.ProcName)
+	} else {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(m.ProcID)))
+	}
+	b = appendUint64(b, 3, m.Start)
+	b = appendUint64(b, 4, m.End)
+	return
+}
+
+func (m *GetRequest) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.ProcID = int32(v)
+			return n
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.ProcName = v
+			return n
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Start = v
+			return n
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.End = v
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+func (m *GetReply) marshal() (b []byte) {
+	b = appendUint64(b, 1, m.Offset)
+	if m.Codec != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.Codec)
+	}
+	b = appendUint64(b, 3, m.Length)
+	if len(m.Data) > 0 {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Data)
+	}
+	return
+}
+
+func (m *GetReply) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Offset = v
+			return n
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.Codec = v
+			return n
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Length = v
+			return n
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			m.Data = append([]byte{}, v...)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+func (m *ReadyRequest) marshal() []byte { return nil }
+
+func (m *ReadyRequest) unmarshal(b []byte) error { return skipAll(b) }
+
+func (m *ReadyReply) marshal() (b []byte) {
+	if m.Ready {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return
+}
+
+func (m *ReadyReply) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			m.Ready = v != 0
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+func (m *ShutdownRequest) marshal() []byte { return nil }
+
+func (m *ShutdownRequest) unmarshal(b []byte) error { return skipAll(b) }
+
+func (m *ShutdownReply) marshal() []byte { return nil }
+
+func (m *ShutdownReply) unmarshal(b []byte) error { return skipAll(b) }
+
+// Zero values are not sent, as in proto3.
+func appendUint64(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// Calls field for each field in b. Field returns the number of bytes
+// consumed or a negative number on error.
+func parse(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func skipAll(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// A gRPC codec for the messages of this package. Other messages are
+// encoded using proto so the codec can be forced on a server that runs
+// other services. The name is "proto" so any gRPC client can talk to
+// the service.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case message:
+		return m.marshal(), nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("grpcsvc: can't marshal %T", v)
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case message:
+		return m.unmarshal(data)
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("grpcsvc: can't unmarshal %T", v)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The failure detector sends a heartbeat to each remote node every
+// App.HeartbeatInterval milliseconds. A node that misses App.HeartbeatMisses
+// heartbeats in a row is dead: the router sends its work to other nodes and
+// the detector tries to reconnect. The node is alive again when it answers
+// a heartbeat.
+
+// Liveness of a remote node as seen by the failure detector.
+type NodeState int
+
+const (
+	NodeUnknown NodeState = iota // not checked yet
+	NodeAlive
+	NodeDead
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeAlive:
+		return "alive"
+	case NodeDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// A change of the state of a remote node.
+type NodeEvent struct {
+	Node     int
+	From, To NodeState
+	Time     time.Time
+	// The last heartbeat error for dead nodes.
+	Err error
+}
+
+var (
+	errNotReady         = errors.New("node is not ready")
+	errHeartbeatTimeout = errors.New("heartbeat timed out")
+)
+
+// Runs the heartbeats.
+type healthChecker struct {
+	mu        sync.Mutex
+	callbacks []func(NodeEvent)
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Registers a function called when a remote node changes state. The
+// function is called by the failure detector and must not block.
+func (app *App) OnNodeChange(fn func(NodeEvent)) {
+	app.health.mu.Lock()
+	defer app.health.mu.Unlock()
+	app.health.callbacks = append(app.health.callbacks, fn)
+}
+
+// Returns the state of node id. The local node is always alive.
+func (app *App) NodeState(id int) NodeState {
+	if app.cluster == nil {
+		return NodeUnknown
+	}
+	if app.cluster.IsLocal(id) {
+		return NodeAlive
+	}
+	node := app.cluster.Node(id)
+	if node == nil {
+		return NodeUnknown
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.state
+}
+
+// Starts a heartbeat goroutine for each remote node.
+func (app *App) startHealthCheck() {
+
+	if app.HeartbeatInterval < 0 {
+		return
+	}
+	interval := time.Duration(app.HeartbeatInterval) * time.Millisecond
+	h := app.health
+	h.stop = make(chan struct{})
+	for _, node := range app.cluster.Nodes {
+		if app.cluster.IsLocal(node.ID) {
+			continue
+		}
+		h.wg.Add(1)
+		go func(node *Node, stop chan struct{}) {
+			defer h.wg.Done()
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+				}
+				app.checkNode(node, interval)
+			}
+		}(node, h.stop)
+	}
+	glog.Infof("failure detector started, heartbeat every %s", interval)
+}
+
+func (app *App) stopHealthCheck() {
+	if app.health.stop == nil {
+		return
+	}
+	close(app.health.stop)
+	app.health.wg.Wait()
+	app.health.stop = nil
+}
+
+// Sends a heartbeat to a node and updates its state. Dead nodes
+// are reconnected.
+func (app *App) checkNode(node *Node, timeout time.Duration) {
+
+	conn, _ := node.connection()
+	err := ping(conn, timeout)
+	if err != nil && app.NodeState(node.ID) == NodeDead {
+		if rerr := app.reconnect(node, timeout); rerr == nil {
+			err = nil
+		}
+	}
+
+	now := time.Now()
+	node.mu.Lock()
+	from := node.state
+	if err == nil {
+		node.misses = 0
+		node.lastSeen = now
+		node.state = NodeAlive
+	} else if node.misses++; node.misses >= app.HeartbeatMisses {
+		node.state = NodeDead
+	}
+	to := node.state
+	node.mu.Unlock()
+
+	// Keep the node suspect while it is dead.
+	if to == NodeDead {
+		app.router.Suspect(node.ID, now.Add(time.Duration(app.SuspectPeriod)*time.Second))
+	}
+	if from == to {
+		return
+	}
+	switch to {
+	case NodeAlive:
+		app.router.Suspect(node.ID, time.Time{})
+		glog.Infof("node %d at %s is alive", node.ID, node.Addr)
+	case NodeDead:
+		glog.Warningf("node %d at %s is dead after %d missed heartbeats: %s",
+			node.ID, node.Addr, app.HeartbeatMisses, err)
+		// Unblock the heartbeats and calls still waiting for the node.
+		// The connection is replaced when the node is reconnected.
+		conn.Close()
+	}
+	app.health.notify(NodeEvent{Node: node.ID, From: from, To: to, Time: now, Err: err})
+}
+
+func (h *healthChecker) notify(ev NodeEvent) {
+	h.mu.Lock()
+	callbacks := h.callbacks
+	h.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(ev)
+	}
+}
+
+// Returns nil if the node is ready before the timeout.
+func ping(conn Conn, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		ready, err := conn.Ready()
+		if err == nil && !ready {
+			err = errNotReady
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errHeartbeatTimeout
+	}
+}
+
+// Opens a new connection to a node and checks that it runs
+// the same processor graph.
+func (app *App) reconnect(node *Node, timeout time.Duration) error {
+
+	conn, err := app.transport.Dial(node.Addr)
+	if err != nil {
+		return err
+	}
+	if err := app.checkConn(conn, timeout); err != nil {
+		conn.Close()
+		glog.V(1).Infof("can't reconnect to node %d: %s", node.ID, err)
+		return err
+	}
+	enc, err := conn.Negotiate(app.encodingOffer())
+	if err != nil {
+		glog.Warningf("can't negotiate encoding with node %d, values will not be encoded: %s", node.ID, err)
+	}
+	old := node.setConnection(conn, enc)
+	if old != nil {
+		old.Close()
+	}
+	glog.Infof("reconnected to node %d at %s", node.ID, node.Addr)
+	return nil
+}
+
+func (app *App) checkConn(conn Conn, timeout time.Duration) error {
+	if err := ping(conn, timeout); err != nil {
+		return err
+	}
+	fp, err := conn.Fingerprint()
+	if err != nil {
+		return err
+	}
+	if want := app.Fingerprint(); fp != want {
+		return fmt.Errorf("node has a different processor graph, fingerprint %s, expected %s", fp, want)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Cached values can expire after a time to live (TTL) or be invalidated
+// explicitly when the data sources change.
+
+// Sets the time to live of the values in the processor cache. Expired
+// values are removed when they are requested and computed again.
+func TTL(ttl time.Duration) ProcOption {
+	return func(ctx *Context) {
+		ctx.ttl = ttl
+		ctx.cache.SetTTL(ttl)
+	}
+}
+
+// Returns the expiration time for a value set now, zero if ttl is zero.
+func expiration(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// Removes the values for keys in [start,end) from the cache of processor
+// procID. The caches of all the processors that depend on it, directly or
+// indirectly, are cleared because we don't know which of their keys depend
+// on the invalidated keys. Use end=NoEnd to invalidate all the keys.
+// In a cluster, the invalidation is sent to all the nodes.
+func (app *App) Invalidate(procID int, start, end uint64) error {
+
+	if err := app.invalidate(procID, start, end); err != nil {
+		return err
+	}
+	if app.cluster == nil {
+		return nil
+	}
+	var errs []error
+	for _, node := range app.cluster.Nodes {
+		if node.ID == app.cluster.NodeID {
+			continue
+		}
+		if err := rpInvalidate(node, procID, start, end); err != nil {
+			errs = append(errs, fmt.Errorf("node %d: %w", node.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Invalidates the keys on the local node.
+func (app *App) invalidate(procID int, start, end uint64) error {
+
+	ctx, ok := app.procs[procID]
+	if !ok {
+		return fmt.Errorf("no processor with id %d", procID)
+	}
+	if end <= start {
+		return fmt.Errorf("invalid key range [%d,%d)", start, end)
+	}
+	n := deleteRange(ctx.cache, start, end)
+	if ctx.spill != nil {
+		ctx.spill.deleteRange(start, end)
+	}
+	atomic.AddUint64(&ctx.stats.numInvalidated, n)
+	glog.V(2).Infof("invalidated %d values of proc %d, keys [%d,%d)", n, procID, start, end)
+
+	for _, dc := range app.downstream(procID) {
+		length, _, _ := dc.cache.Stats()
+		dc.cache.Clear()
+		if dc.spill != nil {
+			dc.spill.clear()
+		}
+		atomic.AddUint64(&dc.stats.numInvalidated, length)
+		glog.V(2).Infof("cleared cache of proc %d, depends on proc %d", dc.id, procID)
+	}
+	return nil
+}
+
+// Deletes the keys in [start,end) from a cache. Returns the
+// number of values deleted.
+func deleteRange(c Cache, start, end uint64) (n uint64) {
+	length, _, _ := c.Stats()
+	if end-start <= length {
+		for k := start; k < end; k++ {
+			if c.Delete(k) {
+				n++
+			}
+		}
+		return
+	}
+	for _, k := range c.Keys() {
+		if k >= start && k < end && c.Delete(k) {
+			n++
+		}
+	}
+	return
+}
+
+// Returns the processors that depend on processor id, directly or
+// indirectly, in ascending id order.
+func (app *App) downstream(id int) []*Context {
+
+	// Map each processor to the processors that use it as input.
+	outputs := make(map[int][]int)
+	for _, ctx := range app.procs {
+		for _, in := range ctx.inputIDs() {
+			outputs[in] = append(outputs[in], ctx.id)
+		}
+	}
+	seen := map[int]bool{id: true}
+	queue := []int{id}
+	var ids []int
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, out := range outputs[cur] {
+			if !seen[out] {
+				seen[out] = true
+				ids = append(ids, out)
+				queue = append(queue, out)
+			}
+		}
+	}
+	sort.Ints(ids)
+	procs := make([]*Context, 0, len(ids))
+	for _, id := range ids {
+		procs = append(procs, app.procs[id])
+	}
+	return procs
+}
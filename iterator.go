@@ -0,0 +1,101 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import "context"
+
+// An Iterator walks the values of a processor in key order. Values
+// ahead of the current key are prefetched in parallel. Example:
+//
+//	it := proc.Iterator(c, 0, 0)
+//	defer it.Close()
+//	for it.Next() {
+//		key, value := it.Key(), it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		// resume later from it.NextKey()
+//	}
+type Iterator struct {
+	p      Processor
+	c      context.Context
+	window uint64
+	s      *Stream
+	key    uint64
+	value  Value
+	next   uint64
+	err    error
+	done   bool
+}
+
+// Returns an iterator that starts at key start. Up to window keys ahead
+// of the current key are computed in the background using App.NumWorkers
+// workers. Keys are requested in blocks of App.BlockSize so remote values
+// are fetched one block per call. If window is zero, the window is
+// 2*NumWorkers*BlockSize.
+func (p Processor) Iterator(c context.Context, start, window uint64) *Iterator {
+	return &Iterator{p: p, c: c, window: window, next: start}
+}
+
+// Advances to the next key. Returns false when there are no more
+// values or an error occurred.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if it.s == nil {
+		it.s = newStream(it.c, it.p, it.next, NoEnd, true, it.window)
+	}
+	pair, ok := <-it.s.C
+	if !ok {
+		it.err = it.s.Err()
+		it.done = true
+		return false
+	}
+	it.key, it.value = pair.Key, pair.Value
+	it.next = pair.Key + 1
+	return true
+}
+
+// The current key.
+func (it *Iterator) Key() uint64 {
+	return it.key
+}
+
+// The value for the current key.
+func (it *Iterator) Value() Value {
+	return it.value
+}
+
+// Returns the error that ended the iteration. Returns nil if the
+// processor returned ErrEndOfArray. (See Stream.Err.)
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// The key where a new iteration should start to resume this one.
+func (it *Iterator) NextKey() uint64 {
+	return it.next
+}
+
+// Moves the iterator to key. The next call to Next returns the
+// value for key. Clears the error so it can be used to retry.
+func (it *Iterator) Seek(key uint64) {
+	it.Close()
+	it.next = key
+	it.err = nil
+	it.done = false
+}
+
+// Stops prefetching. Must be called if the iteration ends before
+// Next returns false.
+func (it *Iterator) Close() {
+	if it.s != nil {
+		it.s.Close()
+		it.s = nil
+	}
+	it.done = true
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Returned by Map when the processor fails for a key.
+type KeyError struct {
+	Key uint64
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %d: %s", e.Key, e.Err)
+}
+
+// Map applies the processor to the key range {start..end-1}.
+// Returns a slice of Values of length (end-start). The keys are
+// processed in parallel using App.NumWorkers workers. Keys routed to
+// remote nodes are requested using one call per contiguous range.
+//
+// If the processor fails, the keys above the failing key are skipped and Map
+// returns the values computed so far and a *KeyError for the lowest failing
+// key, all the values below it are computed. (Use KeyError.Err to check for
+// ErrEndOfArray.)
+func (p Processor) Map(start, end uint64) (values []Value, err error) {
+	return p.MapCtx(context.Background(), start, end)
+}
+
+// Same as Map but the work is cancelled when c is done.
+func (p Processor) MapCtx(c context.Context, start, end uint64) (values []Value, err error) {
+
+	if end < start {
+		return nil, fmt.Errorf("invalid key range {%d..%d}", start, end)
+	}
+	values = make([]Value, end-start)
+	ctx := lookup(p)
+	if ctx == nil {
+		// Not created by an App, do the work sequentially.
+		cp := p.Ctx()
+		for k := range values {
+			key := start + uint64(k)
+			values[k], err = cp(c, key)
+			if err != nil {
+				return values, &KeyError{Key: key, Err: err}
+			}
+		}
+		return values, nil
+	}
+	return values, ctx.app.mapRange(c, ctx, start, values, nil)
+}
+
+// A contiguous range of keys routed to a remote node.
+type keyRun struct {
+	start, end uint64
+	node       *Node
+}
+
+// Computes values for keys {start..start+len(values)-1} in parallel. If done
+// is not nil, done[k] is set when values[k] is computed. (Processors may
+// return nil values.)
+func (app *App) mapRange(c context.Context, ctx *Context, start uint64, values []Value, done []bool) error {
+
+	// After a failure we stop sending keys above the failing key but
+	// finish the keys below it, a lower key may fail too.
+	var mu sync.Mutex
+	var kerr *KeyError
+	fail := func(key uint64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if kerr == nil || key < kerr.Key {
+			kerr = &KeyError{Key: key, Err: err}
+		}
+	}
+	failedBelow := func(key uint64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return kerr != nil && kerr.Key < key
+	}
+
+	local, runs := app.splitRange(ctx, start, values, done)
+
+	// Send all the runs for a node in a single call.
+	var wg sync.WaitGroup
+	for node, runs := range groupRuns(runs) {
+		wg.Add(1)
+		go func(node *Node, runs []keyRun) {
+			defer wg.Done()
+			ranges := make([]RArgs, len(runs))
+			for i, run := range runs {
+				ranges[i] = RArgs{Start: run.start, End: run.end, ProcID: ctx.id}
+				ctx.stats.addRemote()
+			}
+			slices, errs, err := app.rpCallMulti(c, node, ranges)
+			if isNodeError(err) {
+				// The node is now suspect, route the keys again.
+				for _, run := range runs {
+					ctx.stats.addFailover()
+					var d []bool
+					if done != nil {
+						d = done[run.start-start : run.end-start]
+					}
+					if err := app.mapRange(c, ctx, run.start, values[run.start-start:run.end-start], d); err != nil {
+						if kerr, ok := err.(*KeyError); ok {
+							fail(kerr.Key, kerr.Err)
+						} else {
+							fail(run.start, err)
+						}
+					}
+				}
+				return
+			}
+			if err != nil {
+				fail(runs[0].start, err)
+				return
+			}
+			for i, run := range runs {
+				if errs[i] != nil {
+					fail(run.start, errs[i])
+					continue
+				}
+				vals := slices[i]
+				ctx.cache.SetSlice(run.start, vals)
+				copy(values[run.start-start:run.end-start], vals.Data)
+				setDone(done, run.start-start, len(vals.Data))
+				if vals.End() < run.end {
+					fail(vals.End(), ErrEndOfArray)
+				}
+			}
+			ctx.flushSpill()
+		}(node, runs)
+	}
+
+	keys := make(chan uint64)
+	for i := 0; i < app.NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				v, err := ctx.cproc(c, key)
+				if err != nil {
+					fail(key, err)
+					continue
+				}
+				values[key-start] = v
+				setDone(done, key-start, 1)
+			}
+		}()
+	}
+	for _, key := range local {
+		if failedBelow(key) {
+			// The local keys are sorted, the rest are above the failing key too.
+			break
+		}
+		select {
+		case keys <- key:
+		case <-c.Done():
+		}
+		if c.Err() != nil {
+			break
+		}
+	}
+	close(keys)
+	wg.Wait()
+
+	if kerr == nil && c.Err() != nil {
+		// Parent context is done.
+		return c.Err()
+	}
+	if kerr != nil {
+		glog.V(4).Infof("map failed for proc %d: %s", ctx.id, kerr)
+		return kerr
+	}
+	return nil
+}
+
+// Splits a key range into keys to be computed by this node and runs of keys
+// to be requested to remote nodes. Cached values for remote keys are copied to
+// values.
+func (app *App) splitRange(ctx *Context, start uint64, values []Value, done []bool) (local []uint64, runs []keyRun) {
+
+	var run *keyRun
+	for k := range values {
+		key := start + uint64(k)
+		if app.cluster == nil {
+			local = append(local, key)
+			continue
+		}
+		node := app.router.Route(key, ctx.id)
+		if node.ID == app.cluster.NodeID {
+			local = append(local, key)
+			continue
+		}
+		ctx.stats.addRequest()
+		if v, ok := ctx.cache.Get(key); ok {
+			ctx.stats.addCacheHit()
+			values[k] = v
+			setDone(done, uint64(k), 1)
+			continue
+		}
+		ctx.stats.addCacheMiss()
+		if run != nil && run.end == key && run.node.ID == node.ID {
+			run.end++
+			continue
+		}
+		runs = append(runs, keyRun{start: key, end: key + 1, node: node})
+		run = &runs[len(runs)-1]
+	}
+	return
+}
+
+// Marks n keys from offset k as computed, done may be nil.
+func setDone(done []bool, k uint64, n int) {
+	if done == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		done[k+uint64(i)] = true
+	}
+}
+
+// Groups the runs by node.
+func groupRuns(runs []keyRun) map[*Node][]keyRun {
+	m := make(map[*Node][]keyRun)
+	for _, run := range runs {
+		m[run.node] = append(m[run.node], run)
+	}
+	return m
+}
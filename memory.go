@@ -0,0 +1,239 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Caches are bounded by the number of items (capacity) and, optionally,
+// by the estimated number of bytes used by the values.
+
+// Size used when the size of a value can't be estimated.
+const DefaultValueSize = 64
+
+// A Sizer estimates the memory used by a value in bytes.
+type Sizer func(v Value) int
+
+// Values that implement Sized report their own size to DefaultSizer.
+type Sized interface {
+	Size() int
+}
+
+// Estimates the size of a value. Uses the Size method if the value
+// implements Sized, otherwise adds the in-memory size of the value and the
+// data it references: strings, slices, maps and pointers.
+func DefaultSizer(v Value) int {
+	if v == nil {
+		return 0
+	}
+	if s, ok := v.(Sized); ok {
+		return s.Size()
+	}
+	return sizeOf(reflect.ValueOf(v), 0)
+}
+
+// Max number of pointers followed by DefaultSizer, the data
+// below is counted as DefaultValueSize.
+const maxSizeDepth = 8
+
+func sizeOf(v reflect.Value, depth int) int {
+	t := v.Type()
+	if isFlat(t) {
+		return int(t.Size())
+	}
+	if depth > maxSizeDepth {
+		return DefaultValueSize
+	}
+	n := int(t.Size())
+	switch v.Kind() {
+	case reflect.String:
+		n += v.Len()
+	case reflect.Slice:
+		if elem := t.Elem(); isFlat(elem) {
+			n += v.Len() * int(elem.Size())
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			n += sizeOf(v.Index(i), depth+1)
+		}
+	case reflect.Array:
+		n = 0
+		for i := 0; i < v.Len(); i++ {
+			n += sizeOf(v.Index(i), depth+1)
+		}
+	case reflect.Struct:
+		n = 0
+		for i := 0; i < v.NumField(); i++ {
+			n += sizeOf(v.Field(i), depth+1)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			n += sizeOf(iter.Key(), depth+1) + sizeOf(iter.Value(), depth+1)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			n += sizeOf(v.Elem(), depth+1)
+		}
+	}
+	return n
+}
+
+// Caches isFlat by type.
+var flatTypes sync.Map
+
+// True if the values of type t don't reference other data so
+// their size is t.Size().
+func isFlat(t reflect.Type) bool {
+	if flat, ok := flatTypes.Load(t); ok {
+		return flat.(bool)
+	}
+	var flat bool
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		flat = true
+	case reflect.Array:
+		flat = isFlat(t.Elem())
+	case reflect.Struct:
+		flat = true
+		for i := 0; i < t.NumField() && flat; i++ {
+			flat = isFlat(t.Field(i).Type)
+		}
+	}
+	flatTypes.Store(t, flat)
+	return flat
+}
+
+// Tracks the memory used by a cache. Must be used with the cache lock held,
+// except sizeOf.
+type memory struct {
+	maxBytes uint64 // zero means no limit
+	bytes    uint64
+	sizer    atomic.Pointer[Sizer] // nil when not tracking memory
+}
+
+// Returns the estimated size of a value, zero when not tracking memory.
+// Called before taking the cache lock, estimating a size can be slow.
+func (m *memory) sizeOf(v Value) int {
+	if sizer := m.sizer.Load(); sizer != nil {
+		return (*sizer)(v)
+	}
+	return 0
+}
+
+// Same as sizeOf for a list of values.
+func (m *memory) sizesOf(values []Value) []int {
+	sizes := make([]int, len(values))
+	if sizer := m.sizer.Load(); sizer != nil {
+		for i, v := range values {
+			sizes[i] = (*sizer)(v)
+		}
+	}
+	return sizes
+}
+
+// Sets the size of e, computed with sizeOf, and adds it to the total.
+func (m *memory) add(e *entry, size int) {
+	if m.sizer.Load() == nil {
+		return
+	}
+	e.size = size
+	m.bytes += uint64(e.size)
+}
+
+// Removes the size of e from the total.
+func (m *memory) remove(e *entry) {
+	m.bytes -= uint64(e.size)
+	e.size = 0
+}
+
+// Updates the value of e, size is computed with sizeOf.
+func (m *memory) update(e *entry, value Value, size int) {
+	m.remove(e)
+	e.value = value
+	m.add(e, size)
+}
+
+// True if the memory limit is exceeded.
+func (m *memory) over() bool {
+	return m.maxBytes > 0 && m.bytes > m.maxBytes
+}
+
+// Sets the limit and the sizer. If sizer is nil and there is a limit,
+// uses DefaultSizer. The entries are measured again.
+func (m *memory) set(maxBytes uint64, sizer Sizer, entries []*entry) {
+	if sizer == nil && maxBytes > 0 {
+		sizer = DefaultSizer
+	}
+	m.maxBytes = maxBytes
+	if sizer == nil {
+		m.sizer.Store(nil)
+	} else {
+		m.sizer.Store(&sizer)
+	}
+	m.bytes = 0
+	for _, e := range entries {
+		e.size = 0
+		m.add(e, m.sizeOf(e.value))
+	}
+}
+
+// Sets the maximum number of bytes used by the processor cache.
+// Overrides the share of App.MemoryBudget.
+func MaxBytes(n uint64) ProcOption {
+	return func(ctx *Context) {
+		ctx.maxBytes = n
+		ctx.fixedBytes = true
+		ctx.app.splitMemory()
+	}
+}
+
+// Sets the Sizer used to estimate the size of the values in the processor
+// cache. Sizes are only estimated when there is a memory limit.
+func SizeFunc(sizer Sizer) ProcOption {
+	return func(ctx *Context) {
+		ctx.sizer = sizer
+		ctx.cache.SetMaxBytes(ctx.maxBytes, sizer)
+	}
+}
+
+// Splits App.MemoryBudget equally among the processors that don't have
+// their own limit. Called every time a processor is added or configured.
+func (app *App) splitMemory() {
+
+	budget := app.MemoryBudget
+	var shared []*Context
+	for _, ctx := range app.procs {
+		if ctx.fixedBytes {
+			if ctx.maxBytes >= budget {
+				budget = 0
+			} else {
+				budget -= ctx.maxBytes
+			}
+			continue
+		}
+		shared = append(shared, ctx)
+	}
+	for _, ctx := range shared {
+		if app.MemoryBudget == 0 {
+			ctx.maxBytes = 0
+		} else {
+			ctx.maxBytes = budget / uint64(len(shared))
+			if ctx.maxBytes == 0 {
+				ctx.maxBytes = 1 // no room left, zero would mean no limit
+			}
+		}
+	}
+	for _, ctx := range app.procs {
+		ctx.cache.SetMaxBytes(ctx.maxBytes, ctx.sizer)
+		ctx.flushSpill()
+	}
+}
@@ -7,22 +7,33 @@
 package occult
 
 import (
+	"context"
 	"errors"
 	"os"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/golang/glog"
 )
 
 const (
-	DefaultCacheCap          = 2000
-	NumRetries               = 20 // Num attempts to connect to other nodes.
-	DefaultBlockSize  uint64 = 10
-	DefaultNumWorkers        = 2
-	DefaultGoMaxProcs        = 2
+	DefaultCacheCap                 = 2000
+	NumRetries                      = 20 // Num attempts to connect to other nodes.
+	DefaultBlockSize         uint64 = 10
+	DefaultNumWorkers               = 2
+	DefaultGoMaxProcs               = 2
+	DefaultMaxInFlight              = 8     // Max calls in flight to a remote node.
+	DefaultCallTimeout              = 30000 // Milliseconds.
+	DefaultCallRetries              = 2
+	DefaultRetryBackoff             = 100  // Milliseconds.
+	DefaultSuspectPeriod            = 10   // Seconds.
+	DefaultHeartbeatInterval        = 1000 // Milliseconds.
+	DefaultHeartbeatMisses          = 3
 )
 
 var (
@@ -32,11 +43,19 @@ var (
 // All processors must be implemented using this function type.
 type ProcFunc func(key uint64, ctx *Context) (Value, error)
 
+// A context-aware variant of ProcFunc. The context.Context carries the
+// deadline and cancellation signal of the request. To propagate them upstream,
+// call the inputs using Processor.Call.
+type CtxProcFunc func(c context.Context, key uint64, ctx *Context) (Value, error)
+
 // A Processor instance.
 // Once the processor instance is created, the parameters and inputs cannot
 // be changed.
 type Processor func(key uint64) (Value, error)
 
+// A context-aware variant of Processor.
+type CtxProcessor func(c context.Context, key uint64) (Value, error)
+
 // The context provides internal information for processor instances.
 // Each processor instance has a context.
 type Context struct {
@@ -46,48 +65,195 @@ type Context struct {
 	// Uniquely identifies a processor instance in a node.
 	// A proc instance has the same id in all cluster nodes.
 	id       int
-	cache    *cache
-	procFunc ProcFunc
+	name     string
+	cache    Cache
+	policy   CachePolicy
+	procFunc CtxProcFunc
+	funcName string
 	proc     Processor
+	cproc    CtxProcessor
 	inputs   []Processor
 	isSource bool
 	app      *App
+	stats    *stats
+	// The contexts and context-aware variants of the inputs, resolved when
+	// the processor is created. Contexts are nil for the inputs that were
+	// not created by an App.
+	inputCtxs  []*Context
+	inputProcs []CtxProcessor
+	// Type of the values for typed processors, nil otherwise.
+	outType reflect.Type
+	// Memory limit of the cache, zero means no limit. If fixedBytes
+	// is false the limit is a share of App.MemoryBudget.
+	maxBytes   uint64
+	fixedBytes bool
+	sizer      Sizer
+	// True if the capacity was set for this processor. Such
+	// caches are not managed by the capacity manager.
+	fixedCap bool
+	// Time to live of the cached values, zero means no expiration.
+	ttl time.Duration
+	// Second level cache on disk, nil if not used.
+	spill *diskCache
+	// Errors of the options applied to the processor. (See Validate.)
+	optErrs []error
+	// Fetches the next blocks for sequential access, nil if not used.
+	prefetch *prefetcher
+	// Encodes the values sent to other nodes, nil to let the transport do it.
+	codec Codec
+	// Coalesce concurrent cache misses.
+	localFlight  *flight
+	remoteFlight *flight
+}
+
+// Returns the number of calls that were coalesced with an identical
+// call in flight, for local computations and remote block requests.
+func (ctx *Context) Coalesced() (local, remote uint64) {
+	_, local = ctx.localFlight.counts()
+	_, remote = ctx.remoteFlight.counts()
+	return
 }
 
+// Returns the input processors. Use InputsCtx to pass
+// a context.Context to the inputs.
 func (ctx *Context) Inputs() []Processor {
 	return ctx.inputs
 }
 
+// Returns the context-aware variants of the input processors. Same as
+// calling Processor.Ctx on each input but resolved once when the processor
+// is created, use them in a CtxProcFunc.
+func (ctx *Context) InputsCtx() []CtxProcessor {
+	return ctx.inputProcs
+}
+
+// Resolves the contexts of the inputs. Nil inputs are left nil.
+func (ctx *Context) resolveInputs() {
+	ctx.inputCtxs = make([]*Context, len(ctx.inputs))
+	ctx.inputProcs = make([]CtxProcessor, len(ctx.inputs))
+	for i, in := range ctx.inputs {
+		if in == nil {
+			continue
+		}
+		ctx.inputCtxs[i] = lookup(in)
+		ctx.inputProcs[i] = in.Ctx()
+	}
+}
+
 // An App coordinates the execution of a set of processors.
 type App struct {
-	Name       string `yaml:"name"`
-	CacheCap   uint64 `yaml:"cache_cap"`
-	NumWorkers int    `yaml:"num_workers"`
-	BlockSize  uint64 `yaml:"block_size"`
-	NumRetries int    `yaml:"num_retries"`
-	GoMaxProcs int    `yaml:"go_max_procs"`
-	procs      map[int]*Context
+	Name        string      `yaml:"name"`
+	CacheCap    uint64      `yaml:"cache_cap"`
+	CachePolicy CachePolicy `yaml:"cache_policy"`
+	NumWorkers  int         `yaml:"num_workers"`
+	BlockSize   uint64      `yaml:"block_size"`
+	NumRetries  int         `yaml:"num_retries"`
+	GoMaxProcs  int         `yaml:"go_max_procs"`
+	// Memory used by all the caches in bytes, split equally among the
+	// processors. Zero means no limit. (See MaxBytes.)
+	MemoryBudget uint64 `yaml:"memory_budget"`
+	// Total capacity of the caches. If set, the capacity is
+	// redistributed based on hit rates every CapacityPeriod seconds.
+	CapacityBudget uint64 `yaml:"capacity_budget"`
+	CapacityPeriod int    `yaml:"capacity_period"`
+	// Directory for the spill files. (See Spill.)
+	SpillDir string `yaml:"spill_dir"`
+	// Blocks to prefetch for sequential access. (See Prefetch.)
+	PrefetchBlocks int `yaml:"prefetch_blocks"`
+	// Max number of calls in flight to each remote node. Calls made
+	// while serving a remote request are not counted.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Compression for the values sent to this node, "snappy" or "zstd".
+	// Empty means no compression. Payloads smaller than CompressThreshold
+	// bytes are not compressed. (See Codec.)
+	Compression       string `yaml:"compression"`
+	CompressThreshold int    `yaml:"compress_threshold"`
+	// Max time for a call to a remote node in milliseconds. Calls that
+	// fail to reach the node are retried CallRetries times (negative
+	// means no retries) waiting RetryBackoff milliseconds, doubled after
+	// each retry. Then the node is suspect for SuspectPeriod seconds and
+	// its work is sent to other nodes or done locally.
+	CallTimeout   int `yaml:"call_timeout"`
+	CallRetries   int `yaml:"call_retries"`
+	RetryBackoff  int `yaml:"retry_backoff"`
+	SuspectPeriod int `yaml:"suspect_period"`
+	// Milliseconds between heartbeats to each remote node, negative
+	// disables the failure detector. A node is dead after
+	// HeartbeatMisses missed heartbeats. (See NodeState.)
+	HeartbeatInterval int `yaml:"heartbeat_interval"`
+	HeartbeatMisses   int `yaml:"heartbeat_misses"`
+	// Per-processor settings indexed by processor name.
+	Procs map[string]*ProcConfig `yaml:"procs"`
+	procs map[int]*Context
+	names map[string]*Context
 	// The node on which this app is running.
-	cluster   *Cluster
-	router    Router
-	isServer  bool
-	ready     bool
-	terminate chan bool
+	cluster    *Cluster
+	router     Router
+	isServer   bool
+	ready      atomic.Bool
+	terminate  chan bool
+	transport  Transport
+	capManager *capManager
+	health     *healthChecker
+	// Done on Shutdown, for the work done in the background.
+	root   context.Context
+	cancel context.CancelFunc
+	// Processor contexts by closure pointer. (See lookup.)
+	registry map[uintptr]*Context
 }
 
 // Creates a new App.
 func NewApp(config *Config) *App {
 	app := config.App
 	app.procs = make(map[int]*Context)
+	app.names = make(map[string]*Context)
 	app.cluster = config.Cluster
 	if app.cluster != nil {
-		app.router = &blockRouter{
-			numNodes:  len(config.Cluster.Nodes),
-			blockSize: 200,
-			cluster:   app.cluster,
+		app.router = newBlockRouter(app.cluster, 200)
+	}
+	app.terminate = make(chan bool, 1)
+	app.root, app.cancel = context.WithCancel(context.Background())
+	app.capManager = newCapManager()
+	app.health = &healthChecker{}
+	if app.MaxInFlight == 0 {
+		app.MaxInFlight = DefaultMaxInFlight
+	}
+	if app.cluster != nil {
+		for _, node := range app.cluster.Nodes {
+			node.inflight = make(chan struct{}, app.MaxInFlight)
+		}
+		var err error
+		if app.transport, err = newTransport(app.cluster.Transport); err != nil {
+			glog.Fatal(err)
 		}
 	}
-	app.terminate = make(chan bool)
+	if _, ok := compressors[app.Compression]; app.Compression != "" && !ok {
+		glog.Fatalf("unknown compression %q", app.Compression)
+	}
+	if app.CompressThreshold == 0 {
+		app.CompressThreshold = DefaultCompressThreshold
+	}
+	if app.CallTimeout == 0 {
+		app.CallTimeout = DefaultCallTimeout
+	}
+	switch {
+	case app.CallRetries == 0:
+		app.CallRetries = DefaultCallRetries
+	case app.CallRetries < 0:
+		app.CallRetries = 0
+	}
+	if app.RetryBackoff == 0 {
+		app.RetryBackoff = DefaultRetryBackoff
+	}
+	if app.SuspectPeriod == 0 {
+		app.SuspectPeriod = DefaultSuspectPeriod
+	}
+	if app.HeartbeatInterval == 0 {
+		app.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if app.HeartbeatMisses == 0 {
+		app.HeartbeatMisses = DefaultHeartbeatMisses
+	}
 	if app.GoMaxProcs == 0 {
 		app.GoMaxProcs = DefaultGoMaxProcs
 	}
@@ -96,12 +262,18 @@ func NewApp(config *Config) *App {
 		glog.Warningf("using default cache capacity value of %d", app.CacheCap)
 		app.CacheCap = DefaultCacheCap
 	}
+	if _, err := newPolicyCache(app.CachePolicy, 0); err != nil {
+		glog.Fatal(err)
+	}
 	if app.NumWorkers == 0 {
 		app.NumWorkers = DefaultNumWorkers
 	}
 	if app.BlockSize == 0 {
 		app.BlockSize = DefaultBlockSize
 	}
+	if app.CapacityPeriod == 0 {
+		app.CapacityPeriod = DefaultCapacityPeriod
+	}
 	return app
 }
 
@@ -114,13 +286,20 @@ func (app *App) SetServer(b bool) {
 // Must be called after adding processors.
 func (app *App) Run() {
 
+	if err := app.Validate(); err != nil {
+		glog.Fatalf("invalid processor graph: %s", err)
+	}
+	app.startCapacityManager()
+
 	if app.cluster == nil {
 		return // one node
 	}
 
 	// Start local server.
 	addr := app.cluster.LocalNode().Addr
-	go app.rpServe(addr)
+	if err := app.transport.Serve(addr, &RProc{app: app}); err != nil {
+		glog.Fatalf("can't start server on address %s: %s", addr, err)
+	}
 	glog.Infof("server started on address %s", addr)
 
 	// Init clients to connect to remote nodes.
@@ -132,19 +311,38 @@ func (app *App) Run() {
 					glog.Fatalf("too many retries, can't connect to server addr [%s]", node.Addr)
 				}
 				glog.Infof("trying to connect to address %s", node.Addr)
-				node.rpClient, err = rpClient(node.Addr)
+				node.conn, err = app.transport.Dial(node.Addr)
 				if err == nil {
 					break
 				}
 				time.Sleep(5 * time.Second)
 			}
 			glog.Infof("success! conneted to address %s", node.Addr)
+			if node.encoding, err = node.conn.Negotiate(app.encodingOffer()); err != nil {
+				glog.Warningf("can't negotiate encoding with node %d, values will not be encoded: %s", node.ID, err)
+			}
 		}
 	}
 
+	// Make sure all the nodes run the same processor graph.
+	fp := app.Fingerprint()
+	for _, node := range app.cluster.Nodes {
+		if node.ID != app.cluster.NodeID {
+			remote, err := rpFingerprint(node)
+			if err != nil {
+				glog.Fatalf("can't get graph fingerprint from node %d: %s", node.ID, err)
+			}
+			if remote != fp {
+				glog.Fatalf("node %d has a different processor graph, fingerprint %s, expected %s",
+					node.ID, remote, fp)
+			}
+		}
+	}
+	glog.Infof("all nodes have graph fingerprint %s", fp)
+
 	// This node is ready to start working. Need this to make sure we block requests
 	// from other nodes before the connections are initialized.
-	app.ready = true
+	app.ready.Store(true)
 
 	// Wait for all remote nodes to be ready.
 	for _, node := range app.cluster.Nodes {
@@ -158,6 +356,7 @@ func (app *App) Run() {
 	}
 
 	glog.Infof("all remote nodes are ready")
+	app.startHealthCheck()
 
 	// Server mode is done here.
 	if app.isServer {
@@ -169,20 +368,44 @@ func (app *App) Run() {
 	}
 }
 
+// Returns true when the node is connected to the cluster and ready
+// to take requests.
+func (app *App) Ready() bool {
+	return app.ready.Load()
+}
+
+// Terminates this node if it runs in server mode. (See SetServer.)
+// Doesn't block, a node that is not in server mode ignores the request.
+func (app *App) Terminate() {
+	select {
+	case app.terminate <- true:
+	default: // already requested
+	}
+}
+
 // Shutdown all the servers in the cluster.
 func (app *App) Shutdown() {
 
+	app.cancel()
+	app.stopCapacityManager()
+	app.closeSpills()
+	unregister(app)
 	if app.cluster == nil {
 		return // nothing to shut down.
 	}
 
 	glog.Info("shutting down the cluster")
+	app.stopHealthCheck()
 	for _, node := range app.cluster.Nodes {
 		if node.ID != app.cluster.NodeID {
 			glog.Infof("shutting down server %s", node.Addr)
 			rpShutdown(node)
+			if conn, _ := node.connection(); conn != nil {
+				conn.Close()
+			}
 		}
 	}
+	app.transport.Close()
 	glog.Info("shutting down completed")
 }
 
@@ -236,10 +459,16 @@ func (s *Slice) End() uint64 {
 // affinity will increase the cache hit rate and minimize reads from the persistent
 // source.
 func (app *App) AddSource(fn ProcFunc, opt interface{}, inputs ...Processor) Processor {
+	p := app.AddSourceCtx(ctxProcFunc(fn), opt, inputs...)
+	lookup(p).funcName = funcName(fn)
+	return p
+}
+
+// Same as AddSource but using a CtxProcFunc.
+func (app *App) AddSourceCtx(fn CtxProcFunc, opt interface{}, inputs ...Processor) Processor {
 
 	ctx := app.createContext(fn, opt, inputs...)
 	ctx.isSource = true
-	ctx.proc = app.procInstance(ctx)
 	return ctx.proc
 }
 
@@ -247,45 +476,106 @@ func (app *App) AddSource(fn ProcFunc, opt interface{}, inputs ...Processor) Pro
 // The instance may use opt to retrieve parameters and is wired
 // using the inputs.
 func (app *App) Add(fn ProcFunc, opt interface{}, inputs ...Processor) Processor {
+	p := app.AddCtx(ctxProcFunc(fn), opt, inputs...)
+	lookup(p).funcName = funcName(fn)
+	return p
+}
+
+// Same as Add but using a CtxProcFunc.
+func (app *App) AddCtx(fn CtxProcFunc, opt interface{}, inputs ...Processor) Processor {
 
 	ctx := app.createContext(fn, opt, inputs...)
-	ctx.proc = app.procInstance(ctx)
 	return ctx.proc
 }
 
-func (app *App) createContext(fn ProcFunc, opt interface{}, inputs ...Processor) *Context {
+func (app *App) createContext(fn CtxProcFunc, opt interface{}, inputs ...Processor) *Context {
 	id := len(app.procs)
+	cache, _ := newPolicyCache(app.CachePolicy, app.CacheCap)
 	ctx := &Context{
-		// TODO: consider using a circular buffer. For now using LRU.
-		cache:    newCache(app.CacheCap),
+		cache:    cache,
+		policy:   app.CachePolicy,
 		procFunc: fn,
+		funcName: funcName(fn),
 		Options:  opt,
 		inputs:   inputs,
 		id:       id,
 		app:      app,
+		stats:    newStats(),
+
+		localFlight:  newFlight(),
+		remoteFlight: newFlight(),
+	}
+	ctx.resolveInputs()
+	ctx.cproc = app.procInstance(ctx)
+	Prefetch(app.PrefetchBlocks)(ctx)
+	ctx.proc = func(key uint64) (Value, error) {
+		return ctx.cproc(context.Background(), key)
 	}
 	app.procs[id] = ctx
+	register(ctx)
+	app.splitMemory()
 	return ctx
 }
 
+// Returns the name of a function using reflection.
+func funcName(fn interface{}) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
+// Wraps a ProcFunc, the context.Context is ignored.
+func ctxProcFunc(fn ProcFunc) CtxProcFunc {
+	return func(c context.Context, key uint64, ctx *Context) (Value, error) {
+		return fn(key, ctx)
+	}
+}
+
 // Closure to generate a Processor with parameter id and cache.
-func (app *App) procInstance(ctx *Context) Processor {
+func (app *App) procInstance(ctx *Context) CtxProcessor {
 
-	return func(key uint64) (Value, error) {
+	return func(c context.Context, key uint64) (value Value, err error) {
 
-		var err error
 		var vals *Slice
 
+		ctx.stats.addRequest()
+		defer func(t time.Time) {
+			ctx.stats.addResult(time.Since(t), err)
+		}(time.Now())
+		defer ctx.flushSpill()
+
+		// Give up if the request was cancelled or timed out.
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+
+		// Start fetching the next blocks if the keys are requested in order.
+		if ctx.prefetch != nil {
+			ctx.prefetch.observe(key)
+		}
+
 		// First, we check if the data is already in the cache.
-		if v, ok := ctx.cache.get(key); ok {
+		if v, ok := ctx.cache.Get(key); ok {
 			if glog.V(7) {
 				glog.Infof("cache hit in proc %d\n", ctx.id)
 			}
+			ctx.stats.addCacheHit()
 			return v, nil
 		}
+		ctx.stats.addCacheMiss()
 
-		// Check if we need to send teh work to a remote node.
-		if app.cluster != nil {
+		// Then, we check the second level cache on disk.
+		if ctx.spill != nil {
+			if v, ok := ctx.spill.get(key); ok {
+				ctx.cache.Set(key, v)
+				return v, nil
+			}
+		}
+
+		// Check if we need to send teh work to a remote node. If the node
+		// is unreachable, the router sends the work somewhere else.
+		for i := 0; app.cluster != nil && i < len(app.cluster.Nodes); i++ {
 			// Let router do the magic, tell us where to send the work.
 			targetNode := app.router.Route(key, ctx.id)
 
@@ -300,123 +590,143 @@ func (app *App) procInstance(ctx *Context) Processor {
 			}
 
 			// Skip remote call if work is done by this node.
-			if targetNode.ID != app.cluster.NodeID {
+			if targetNode.ID == app.cluster.NodeID {
+				break
+			}
 
-				// Prepare to send work to remote node and wait for results.
+			// Prepare to send work to remote node and wait for results.
 
-				// For efficiency, we request a block of keys at a time.
-				// Key are mapped to blocks. blockStart() returns the start of the block.
-				start := blockStart(key, app.BlockSize)
-				// Get the slice from the remote node.
-				vals, err = app.rpCallSlice(start, start+app.BlockSize, ctx.id, targetNode)
-				if err != nil || vals.Length() == 0 {
-					return nil, err
-				}
-				// Save the slice in the cache.
-				ctx.cache.setSlice(start, vals)
-				// Return only the value for key requested (not the slice).
-				// blockIndex() maps the requested key to the slice index.
-				return vals.Data[blockIndex(key, app.BlockSize)], nil
+			// For efficiency, we request a block of keys at a time.
+			// Key are mapped to blocks. blockStart() returns the start of the block.
+			start := blockStart(key, app.BlockSize)
+			vals, err = app.fetchBlock(c, ctx, start, targetNode)
+			if isNodeError(err) {
+				ctx.stats.addFailover()
+				continue
+			}
+			if err != nil {
+				return nil, err
 			}
+			// Return only the value for key requested (not the slice).
+			// blockIndex() maps the requested key to the slice index.
+			idx := blockIndex(key, app.BlockSize)
+			if idx >= vals.Length() {
+				return nil, ErrEndOfArray
+			}
+			return vals.Data[idx], nil
 		}
 
-		// Do local computation.
-		result, err := ctx.procFunc(key, ctx)
+		return app.computeLocal(c, ctx, key)
+	}
+}
+
+// Gets the block that starts at key start from a remote node and saves it
+// in the cache. Concurrent requests for the same block share a single
+// remote call.
+func (app *App) fetchBlock(c context.Context, ctx *Context, start uint64, node *Node) (*Slice, error) {
+	v, err := ctx.remoteFlight.do(c, start, func() (Value, error) {
+		ctx.stats.addRemote()
+		vals, err := app.rpCallSlice(c, start, start+app.BlockSize, ctx.id, node)
 		if err != nil {
 			return nil, err
 		}
-		ctx.cache.set(key, result)
-		return result, nil
+		// Save the slice in the cache.
+		ctx.cache.SetSlice(start, vals)
+		return vals, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(*Slice), nil
 }
 
-// Map applies the processor to the key range {start..end}.
-// Returns a slice of Values of length (end-start).
-func (p Processor) Map(start, end uint64) (values []Value, err error) {
-
-	values = make([]Value, end-start)
-	for k, _ := range values {
-		values[k], err = p(uint64(k))
+// Computes the value for key on this node and saves it in the cache.
+// Concurrent misses for the same key share a single computation.
+func (app *App) computeLocal(c context.Context, ctx *Context, key uint64) (Value, error) {
+	return ctx.localFlight.do(c, key, func() (Value, error) {
+		// The value may have been cached after our cache miss.
+		if v, ok := ctx.cache.Get(key); ok {
+			return v, nil
+		}
+		ctx.stats.addLocal()
+		result, err := ctx.procFunc(c, key, ctx)
 		if err != nil {
-			return
+			return nil, err
 		}
-	}
-	return
+		ctx.cache.Set(key, result)
+		return result, nil
+	})
 }
 
-// MapAll applies the processor to the processor values
-// with key range {start..}.
-func (p Processor) MapAll(start uint64, ctx *Context) chan Value {
-	out := make(chan Value, ctx.app.NumWorkers)
-	go master(p, ctx.app.NumWorkers, ctx.app.BlockSize, out)
-	return out
+// Call gets the value for key. The context.Context c is propagated
+// to the processor and its inputs so the request can be cancelled or
+// bounded by a deadline. Call looks up the processor, inside a
+// CtxProcFunc use Context.InputsCtx instead.
+func (p Processor) Call(c context.Context, key uint64) (Value, error) {
+	return p.Ctx()(c, key)
 }
 
-// Provides keys to workers.
-type counter struct {
-	k    uint64
-	size uint64
-	sync.Mutex
+// Returns the context-aware variant of the processor. If p was not
+// created by an App, the returned function only checks c before calling p.
+func (p Processor) Ctx() CtxProcessor {
+	if ctx := lookup(p); ctx != nil {
+		return ctx.cproc
+	}
+	return func(c context.Context, key uint64) (Value, error) {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		return p(key)
+	}
 }
 
-// Safely returns the start of the next block.
-func (c *counter) block() uint64 {
-	c.Lock()
-	defer c.Unlock()
-	v := c.k
-	c.k += c.size
-	return v
+// Apps that are not shut down. Processors are closures so each app
+// indexes its processor contexts by closure pointer. The lock also
+// guards App.registry.
+var liveApps = struct {
+	sync.RWMutex
+	m map[*App]bool
+}{m: make(map[*App]bool)}
+
+// Returns the closure pointer for a processor value.
+func procPtr(p Processor) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&p))
 }
 
-// Worker does work for block of keys obtained (safely) from counter.
-func (c *counter) worker(p Processor, values chan Value) {
-	for {
-		start := c.block()
-		for key := start; key < start+c.size; key++ {
-			v, err := p(key)
-			if err != nil {
-				glog.V(4).Infof("worker exiting with err: %s", err)
-				values <- nil
-				return
-			}
-			values <- v
-		}
+func register(ctx *Context) {
+	liveApps.Lock()
+	defer liveApps.Unlock()
+	app := ctx.app
+	if app.registry == nil {
+		app.registry = make(map[uintptr]*Context)
 	}
+	app.registry[procPtr(ctx.proc)] = ctx
+	liveApps.m[app] = true
 }
 
-// Coordinate workers.
-// TODO: num workers for local vs. remote work is the same.
-// We need separate params because local depends on the number of cores
-// and remote depends on the network topology. To do this we will
-// need to determine local vs. remote upstream instead of downstream
-// from here.
-func master(p Processor, numWorkers int, size uint64, out chan Value) {
-
-	//values := make(chan Value)
-	values := make(chan Value, 1000)
-	cnt := counter{size: size}
-	for i := 0; i < numWorkers; i++ {
-		go cnt.worker(p, values)
-	}
-
-	// TODO: add timeout
-	n := 0
-	for {
-		v := <-values
-		if v == nil {
-			n++ // increment when worker finishes.
-			glog.V(4).Infof("master got nil, n:%d", n)
-		} else {
-			glog.V(4).Infof("master send out")
-			out <- v
-		}
-		if n == numWorkers {
-			glog.V(4).Infof("master closing")
-			close(values)
-			close(out)
-			return
+// Forgets the processors of an app. Called on Shutdown.
+func unregister(app *App) {
+	liveApps.Lock()
+	defer liveApps.Unlock()
+	delete(liveApps.m, app)
+	app.registry = nil
+}
+
+// Returns the context of a processor or nil if the processor was
+// not created by an App or the App was shut down.
+func lookup(p Processor) *Context {
+	if p == nil {
+		return nil
+	}
+	ptr := procPtr(p)
+	liveApps.RLock()
+	defer liveApps.RUnlock()
+	for app := range liveApps.m {
+		if ctx, ok := app.registry[ptr]; ok {
+			return ctx
 		}
 	}
+	return nil
 }
 
 // Returns the index in a block given key and block size.
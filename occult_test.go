@@ -6,12 +6,24 @@
 package occult
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
 	"os"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Options struct {
@@ -112,8 +124,1078 @@ func TestQuantiles(t *testing.T) {
 	// test Map
 	values, err := sorted.Map(100, 103)
 	FatalIf(t, err)
-	_ = values
+	expect(t, len(values), 3)
+	for k, v := range values {
+		w, e := sorted(uint64(100 + k))
+		FatalIf(t, e)
+		if !reflect.DeepEqual(v, w) {
+			t.Fatalf("value mismatch for key %d", 100+k)
+		}
+	}
 	//t.Logf("slice values: %#v", values)
+
+	// Map past the end of the array.
+	values, err = randomInts.Map(uint64(n-5), uint64(n+5))
+	kerr, ok := err.(*KeyError)
+	if !ok {
+		t.Fatalf("expected *KeyError, got %v", err)
+	}
+	expect(t, kerr.Key, uint64(n))
+	expect(t, kerr.Err, ErrEndOfArray)
+	for k, v := range values[:5] {
+		if v != nil {
+			expect(t, v, opt.intSlice[n-5+k])
+		}
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100)}
+	config := &Config{App: &App{Name: "test", CacheCap: 100}}
+	app := NewApp(config)
+	slow := func(c context.Context, idx uint64, ctx *Context) (Value, error) {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-c.Done():
+		}
+		// Both cases may be ready when the test runs slowly.
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		return randomFunc(idx, ctx)
+	}
+	randomInts := app.AddSourceCtx(slow, opt, nil)
+	double := app.AddCtx(func(c context.Context, idx uint64, ctx *Context) (Value, error) {
+		v, err := ctx.InputsCtx()[0](c, idx)
+		if err != nil {
+			return nil, err
+		}
+		return 2 * v.(int), nil
+	}, opt, randomInts)
+
+	v, err := double(5)
+	FatalIf(t, err)
+	expect(t, v, 2*opt.intSlice[5])
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = double.Call(c, 6)
+	expect(t, err, context.Canceled)
+
+	c, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = double.Call(c, 7)
+	expect(t, err, context.DeadlineExceeded)
+
+	// Failed calls must not be cached.
+	v, err = double.Call(context.Background(), 7)
+	FatalIf(t, err)
+	expect(t, v, 2*opt.intSlice[7])
+
+	// The app forgets its processors on Shutdown.
+	app.Shutdown()
+	if lookup(double) != nil {
+		t.Error("processor is still registered after Shutdown")
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100)}
+	config := &Config{App: &App{Name: "test", CacheCap: 100}}
+	app := NewApp(config)
+	var n int32
+	slow := func(idx uint64, ctx *Context) (Value, error) {
+		atomic.AddInt32(&n, 1)
+		time.Sleep(20 * time.Millisecond)
+		return randomFunc(idx, ctx)
+	}
+	randomInts := app.AddSource(slow, opt, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := randomInts(3)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			expect(t, v, opt.intSlice[3])
+		}()
+	}
+	wg.Wait()
+	expect(t, atomic.LoadInt32(&n), int32(1))
+	local, _ := app.Context(0).Coalesced()
+	if local == 0 {
+		t.Errorf("expected coalesced calls, got 0")
+	}
+}
+
+func TestCoalescePanic(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100)}
+	config := &Config{App: &App{Name: "test", CacheCap: 100}}
+	app := NewApp(config)
+	var n int32
+	started := make(chan struct{})
+	flaky := func(idx uint64, ctx *Context) (Value, error) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			close(started)
+			time.Sleep(20 * time.Millisecond)
+			panic("boom")
+		}
+		return randomFunc(idx, ctx)
+	}
+	randomInts := app.AddSource(flaky, opt, nil)
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := randomInts(3)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := randomInts(3)
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil || !strings.Contains(err.Error(), "boom") {
+				t.Fatalf("expected panic error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("caller blocked after a panic")
+		}
+	}
+
+	// The key is no longer in flight.
+	v, err := randomInts(3)
+	FatalIf(t, err)
+	expect(t, v, opt.intSlice[3])
+}
+
+func TestStats(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	config := &Config{App: &App{Name: "test", CacheCap: 1000}}
+	app := NewApp(config)
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	window := app.Add(windowFunc, opt, randomInts)
+
+	var i uint64
+	for ; ; i++ {
+		if _, e := window(i); e != nil {
+			expect(t, e, ErrEndOfArray)
+			break
+		}
+	}
+	window(0) // cache hit
+
+	st := app.Stats()
+	ws := st[1]
+	expect(t, ws.Requests, i+2)
+	expect(t, ws.CacheHits, uint64(1))
+	expect(t, ws.CacheMisses, i+1)
+	expect(t, ws.Local, i+1)
+	expect(t, ws.EndOfArray, uint64(1))
+	expect(t, ws.Errors, uint64(0))
+	expect(t, ws.Latency.Count, ws.Requests)
+
+	// Windows overlap so the source has cache hits.
+	rs := st[0]
+	expect(t, rs.CacheMisses, rs.Local)
+	expect(t, rs.CacheLen, uint64(len(opt.intSlice)))
+	if rs.HitRate() <= 0.4 {
+		t.Errorf("expected hit rate above 0.4, got %.2f", rs.HitRate())
+	}
+}
+
+func TestStatusPages(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	config := &Config{App: &App{Name: "test", CacheCap: 1000}}
+	app := NewApp(config)
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	window := app.Add(windowFunc, opt, randomInts)
+	window(3)
+
+	mux := http.NewServeMux()
+	app.handleStatus(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + StatusPath)
+	FatalIf(t, err)
+	var st Status
+	FatalIf(t, json.NewDecoder(resp.Body).Decode(&st))
+	resp.Body.Close()
+	expect(t, st.App, "test")
+	expect(t, len(st.Procs), 2)
+	expect(t, st.Procs[0].Source, true)
+	expect(t, st.Procs[1].Inputs[0], 0)
+	expect(t, st.Procs[1].CacheLen, uint64(1))
+
+	resp, err = http.Get(server.URL + MetricsPath)
+	FatalIf(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	FatalIf(t, err)
+	resp.Body.Close()
+	for _, line := range []string{
+		`occult_requests_total{app="test",node="0",proc="1"} 1`,
+		`occult_local_total{app="test",node="0",proc="0"} 10`,
+		`occult_request_duration_seconds_count{app="test",node="0",proc="1"} 1`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("metrics page is missing %q", line)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+
+	n := 1000
+	opt := &Options{intSlice: getRandomInts(n)}
+	config := &Config{App: &App{Name: "test", CacheCap: 100, NumWorkers: 4}}
+	app := NewApp(config)
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	errKey := errors.New("bad key")
+	faulty := app.Add(func(idx uint64, ctx *Context) (Value, error) {
+		if idx == 500 {
+			return nil, errKey
+		}
+		if idx%2 == 0 {
+			return nil, nil // nil is a legit value
+		}
+		return ctx.Inputs()[0](idx)
+	}, opt, randomInts)
+
+	// Ordered until the end of the array.
+	s := randomInts.Stream(context.Background(), 5, NoEnd)
+	key := uint64(5)
+	for pair := range s.C {
+		expect(t, pair.Key, key)
+		expect(t, pair.Value, opt.intSlice[key])
+		key++
+	}
+	FatalIf(t, s.Err())
+	expect(t, key, uint64(n))
+
+	// Bounded range, unordered.
+	s = randomInts.StreamUnordered(context.Background(), 10, 35)
+	sum := uint64(0)
+	for pair := range s.C {
+		sum += pair.Key
+	}
+	FatalIf(t, s.Err())
+	expect(t, sum, uint64((10+34)*25/2))
+
+	// Error ends the stream, nil values don't.
+	s = faulty.Stream(context.Background(), 0, NoEnd)
+	key = 0
+	for pair := range s.C {
+		expect(t, pair.Key, key)
+		key++
+	}
+	expect(t, key, uint64(500))
+	kerr, ok := s.Err().(*KeyError)
+	if !ok {
+		t.Fatalf("expected *KeyError, got %v", s.Err())
+	}
+	expect(t, kerr.Key, uint64(500))
+	expect(t, kerr.Err, errKey)
+
+	// Stop early.
+	c, cancel := context.WithCancel(context.Background())
+	s = randomInts.Stream(c, 0, NoEnd)
+	<-s.C
+	cancel()
+	for range s.C {
+	}
+	expect(t, s.Err(), context.Canceled)
+
+	// MapAll honors start.
+	cnt := 0
+	for range randomInts.MapAll(uint64(n-10), app.Context(0)) {
+		cnt++
+	}
+	expect(t, cnt, 10)
+
+	// MapAll closes the channel when cancelled, even if nobody reads it.
+	c, cancel = context.WithCancel(context.Background())
+	ch := randomInts.MapAllCtx(c, 0, app.Context(0))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			t.Fatal("MapAll channel was not closed")
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+
+	n := 1000
+	opt := &Options{intSlice: getRandomInts(n)}
+	config := &Config{App: &App{Name: "test", CacheCap: 2000, NumWorkers: 3, BlockSize: 10}}
+	app := NewApp(config)
+	var maxKey uint64
+	randomInts := app.AddSource(func(idx uint64, ctx *Context) (Value, error) {
+		for {
+			m := atomic.LoadUint64(&maxKey)
+			if idx <= m || atomic.CompareAndSwapUint64(&maxKey, m, idx) {
+				break
+			}
+		}
+		return randomFunc(idx, ctx)
+	}, opt, nil)
+
+	// The window limits prefetching.
+	it := randomInts.Iterator(context.Background(), 0, 50)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if m := atomic.LoadUint64(&maxKey); m >= 50+10 {
+		t.Fatalf("prefetched too far: %d", m)
+	}
+	for it.Next() {
+		expect(t, it.Value(), opt.intSlice[it.Key()])
+		if it.Key() == 99 {
+			break
+		}
+	}
+	expect(t, it.NextKey(), uint64(100))
+
+	// Resume.
+	it.Seek(it.NextKey())
+	cnt := 0
+	for it.Next() {
+		expect(t, it.Key(), uint64(100+cnt))
+		cnt++
+	}
+	FatalIf(t, it.Err())
+	expect(t, cnt, n-100)
+	it.Close()
+}
+
+func TestPrefetch(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(45)}
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100, BlockSize: 10}})
+	randomInts := app.AddSource(randomFunc, opt, nil).With(Prefetch(2))
+	ctx := lookup(randomInts)
+
+	for k := uint64(0); k < 5; k++ {
+		_, err := randomInts(k)
+		FatalIf(t, err)
+	}
+	// Blocks 1 and 2 are fetched in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.Stats().Prefetched < 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetched %d values, expected 20", ctx.Stats().Prefetched)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hits := ctx.Stats().CacheHits
+	v, err := randomInts(25)
+	FatalIf(t, err)
+	expect(t, v, opt.intSlice[25])
+	expect(t, ctx.Stats().CacheHits, hits+1)
+
+	// Prefetching stops at the end of the array.
+	for k := uint64(26); k < 45; k++ {
+		_, err := randomInts(k)
+		FatalIf(t, err)
+	}
+	_, err = randomInts(45)
+	expect(t, err, ErrEndOfArray)
+
+	// Nothing is fetched after Shutdown.
+	app.Shutdown()
+	expect(t, ctx.prefetch.fetch(0), false)
+}
+
+// Connects a node to an app using a pipe.
+func pipeNode(t *testing.T, app *App, maxInFlight int) *Node {
+	srv := rpc.NewServer()
+	FatalIf(t, srv.Register(&RProc{app: app}))
+	c1, c2 := net.Pipe()
+	go srv.ServeConn(c1)
+	t.Cleanup(func() { c2.Close() })
+	return &Node{ID: 1, conn: &rpcConn{rpc.NewClient(c2)}, inflight: make(chan struct{}, maxInFlight)}
+}
+
+func TestRemoteCalls(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(45)}
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	id := lookup(randomInts).id
+	node := pipeNode(t, app, 2)
+	c := context.Background()
+
+	// The slice is truncated at the end of the array.
+	sl, err := app.rpCallSlice(c, 40, 50, id, node)
+	FatalIf(t, err)
+	expect(t, sl.Length(), 5)
+	expect(t, sl.Data[4], opt.intSlice[44])
+	_, err = app.rpCall(c, 45, id, node)
+	expect(t, err, ErrEndOfArray)
+
+	slices, errs, err := app.rpCallMulti(c, node, []RArgs{
+		{Start: 0, End: 10, ProcID: id},
+		{Start: 40, End: 50, ProcID: id},
+		{Start: 0, End: 10, ProcID: 99},
+	})
+	FatalIf(t, err)
+	expect(t, slices[0].Length(), 10)
+	expect(t, slices[0].Data[3], opt.intSlice[3])
+	expect(t, slices[1].Length(), 5)
+	FatalIf(t, errs[0])
+	FatalIf(t, errs[1])
+	if errs[2] == nil {
+		t.Error("expected error for unknown processor")
+	}
+
+	// Wait for a free slot until the deadline.
+	node.inflight <- struct{}{}
+	node.inflight <- struct{}{}
+	tc, cancel := context.WithTimeout(c, 20*time.Millisecond)
+	defer cancel()
+	_, err = app.rpCallSlice(tc, 0, 10, id, node)
+	expect(t, err, context.DeadlineExceeded)
+	<-node.inflight
+	_, err = app.rpCallSlice(c, 0, 10, id, node)
+	FatalIf(t, err)
+	expect(t, len(node.inflight), 1)
+
+	// Calls made while serving a remote request don't take a slot.
+	node.inflight <- struct{}{}
+	sc, cancel := timeoutContext(time.Second)
+	defer cancel()
+	_, err = app.rpCallSlice(sc, 0, 10, id, node)
+	FatalIf(t, err)
+	expect(t, len(node.inflight), 2)
+}
+
+func TestChanTransport(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(300)}
+	apps := make([]*App, 2)
+	procs := make([]Processor, 2)
+	for i := range apps {
+		cluster := &Cluster{
+			Nodes:     []*Node{{ID: 0, Addr: "chan-test-0"}, {ID: 1, Addr: "chan-test-1"}},
+			NodeID:    i,
+			Transport: "chan",
+		}
+		apps[i] = NewApp(&Config{App: &App{Name: "test", CacheCap: 1000}, Cluster: cluster})
+		procs[i] = apps[i].AddSource(randomFunc, opt, nil)
+	}
+	done := make(chan bool)
+	go func() {
+		apps[0].Run()
+		close(done)
+	}()
+	apps[1].Run()
+	<-done
+	defer apps[0].transport.Close()
+	defer apps[0].stopHealthCheck()
+	defer apps[1].Shutdown()
+
+	// Keys 200..399 are routed to node 1.
+	values, err := procs[0].Map(190, 310)
+	expect(t, err.(*KeyError).Key, uint64(300))
+	for i, v := range values[:110] {
+		expect(t, v, opt.intSlice[190+i])
+	}
+	v, err := procs[1](5)
+	FatalIf(t, err)
+	expect(t, v, opt.intSlice[5])
+	expect(t, apps[0].Stats()[lookup(procs[0]).id].Remote, uint64(1))
+	expect(t, apps[1].Stats()[lookup(procs[1]).id].Remote, uint64(1))
+
+	// Shutdown is ignored by nodes that are not in server mode.
+	FatalIf(t, apps[1].cluster.Node(0).conn.Shutdown())
+
+	if _, err := newTransport("carrier-pigeon"); err == nil {
+		t.Error("expected error for unknown transport")
+	}
+}
+
+// Nil values computed by a remote node are not holes.
+func TestRemoteNilValues(t *testing.T) {
+
+	evens := func(key uint64, ctx *Context) (Value, error) {
+		if key%2 == 0 {
+			return nil, nil
+		}
+		return int(key), nil
+	}
+	apps := make([]*App, 2)
+	procs := make([]Processor, 2)
+	for i := range apps {
+		cluster := &Cluster{
+			Nodes:     []*Node{{ID: 0, Addr: "nil-test-0"}, {ID: 1, Addr: "nil-test-1"}},
+			NodeID:    i,
+			Transport: "chan",
+		}
+		apps[i] = NewApp(&Config{App: &App{Name: "test", CacheCap: 1000}, Cluster: cluster})
+		procs[i] = apps[i].AddSource(evens, nil, nil)
+	}
+	done := make(chan bool)
+	go func() {
+		apps[0].Run()
+		close(done)
+	}()
+	apps[1].Run()
+	<-done
+	defer apps[0].transport.Close()
+	defer apps[0].stopHealthCheck()
+	defer apps[1].Shutdown()
+
+	// Keys 200..399 are routed to node 1.
+	v, err := procs[0](251)
+	FatalIf(t, err)
+	expect(t, v, 251)
+	values, err := procs[0].Map(190, 230)
+	FatalIf(t, err)
+	for i, v := range values {
+		if key := 190 + i; key%2 == 0 {
+			expect(t, v, nil)
+		} else {
+			expect(t, v, key)
+		}
+	}
+	sl, err := apps[1].GetRange(context.Background(), 0, 200, 210)
+	FatalIf(t, err)
+	expect(t, sl.Length(), 10)
+}
+
+func TestMapEndOfArray(t *testing.T) {
+
+	// The remote end of array is reported while node 0 is still
+	// computing its keys.
+	opt := &Options{intSlice: getRandomInts(300)}
+	slow := func(idx uint64, ctx *Context) (Value, error) {
+		if idx < 200 {
+			time.Sleep(time.Millisecond)
+		}
+		return randomFunc(idx, ctx)
+	}
+	apps := make([]*App, 2)
+	procs := make([]Processor, 2)
+	for i := range apps {
+		cluster := &Cluster{
+			Nodes:     []*Node{{ID: 0, Addr: "chan-map-0"}, {ID: 1, Addr: "chan-map-1"}},
+			NodeID:    i,
+			Transport: "chan",
+		}
+		apps[i] = NewApp(&Config{App: &App{Name: "test", CacheCap: 1000}, Cluster: cluster})
+		procs[i] = apps[i].AddSource(slow, opt, nil)
+	}
+	done := make(chan bool)
+	go func() {
+		apps[0].Run()
+		close(done)
+	}()
+	apps[1].Run()
+	<-done
+	defer apps[0].transport.Close()
+	defer apps[0].stopHealthCheck()
+	defer apps[1].Shutdown()
+
+	values, err := procs[0].Map(0, 310)
+	kerr := err.(*KeyError)
+	expect(t, kerr.Key, uint64(300))
+	for i, v := range values[:kerr.Key] {
+		if v == nil {
+			t.Fatalf("missing value for key %d", i)
+		}
+		expect(t, v, opt.intSlice[i])
+	}
+}
+
+func TestFailover(t *testing.T) {
+
+	apps := make([]*App, 2)
+	procs := make([]Processor, 2)
+	hang := make(chan struct{})
+	for i := range apps {
+		cluster := &Cluster{
+			Nodes:     []*Node{{ID: 0, Addr: "failover-test-0"}, {ID: 1, Addr: "failover-test-1"}},
+			NodeID:    i,
+			Transport: "chan",
+		}
+		apps[i] = NewApp(&Config{App: &App{Name: "test", CacheCap: 1000,
+			CallTimeout: 50, CallRetries: 1, RetryBackoff: 1, SuspectPeriod: 60, HeartbeatInterval: -1}, Cluster: cluster})
+		nodeID := i
+		procs[i] = apps[i].AddSource(func(key uint64, ctx *Context) (Value, error) {
+			// Node 1 hangs for keys below 300.
+			if nodeID == 1 && key < 300 {
+				<-hang
+			}
+			return int(key), nil
+		}, nil)
+	}
+	done := make(chan bool)
+	go func() {
+		apps[0].Run()
+		close(done)
+	}()
+	apps[1].Run()
+	<-done
+	defer apps[0].transport.Close()
+	defer apps[1].transport.Close()
+	defer close(hang)
+	id := lookup(procs[0]).id
+
+	// Keys 200..399 are routed to node 1. It is slow, the call times
+	// out but the node is not suspect.
+	_, err := procs[0](250)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	expect(t, apps[0].router.Route(250, id).ID, 1)
+	_, err = procs[0].Map(200, 220)
+	var kerr *KeyError
+	if !errors.As(err, &kerr) || kerr.Key != 200 || !errors.Is(kerr.Err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout for key 200, got %v", err)
+	}
+	expect(t, apps[0].router.Route(250, id).ID, 1)
+	expect(t, apps[0].Stats()[id].Failovers, uint64(0))
+
+	// Node 1 is down, the keys are computed locally.
+	FatalIf(t, apps[1].transport.Close())
+	v, err := procs[0](310)
+	FatalIf(t, err)
+	expect(t, v, 310)
+	expect(t, apps[0].router.Route(250, id).ID, 0)
+	expect(t, apps[0].Stats()[id].Failovers, uint64(1))
+
+	// Map falls back too.
+	apps[0].router.Suspect(1, time.Time{})
+	values, err := procs[0].Map(200, 220)
+	FatalIf(t, err)
+	for i, v := range values {
+		expect(t, v, 200+i)
+	}
+	expect(t, apps[0].Stats()[id].Failovers, uint64(2))
+
+	// Errors returned by the remote node are not retried.
+	_, err = apps[0].rpCallSlice(context.Background(), 0, 1, 99, apps[1].cluster.Node(0))
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected remote error, got %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(500)}
+	apps := make([]*App, 2)
+	procs := make([]Processor, 2)
+	for i := range apps {
+		cluster := &Cluster{
+			Nodes:     []*Node{{ID: 0, Addr: "health-test-0"}, {ID: 1, Addr: "health-test-1"}},
+			NodeID:    i,
+			Transport: "chan",
+		}
+		apps[i] = NewApp(&Config{App: &App{Name: "test", CacheCap: 1000,
+			HeartbeatInterval: 10, HeartbeatMisses: 2}, Cluster: cluster})
+		procs[i] = apps[i].AddSource(randomFunc, opt, nil)
+	}
+	events := make(chan NodeEvent, 10)
+	apps[0].OnNodeChange(func(ev NodeEvent) { events <- ev })
+	done := make(chan bool)
+	go func() {
+		apps[0].Run()
+		close(done)
+	}()
+	apps[1].Run()
+	<-done
+	defer apps[0].transport.Close()
+	defer apps[1].transport.Close()
+	defer apps[0].stopHealthCheck()
+	defer apps[1].stopHealthCheck()
+	id := lookup(procs[0]).id
+
+	next := func(to NodeState) NodeEvent {
+		select {
+		case ev := <-events:
+			expect(t, ev.Node, 1)
+			expect(t, ev.To, to)
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("node 1 is not %s", to)
+		}
+		return NodeEvent{}
+	}
+	next(NodeAlive)
+	expect(t, apps[0].NodeState(1), NodeAlive)
+	expect(t, apps[0].Status().Nodes[1].State, "alive")
+
+	// Node 1 stops, its keys are computed by node 0.
+	FatalIf(t, apps[1].transport.Close())
+	ev := next(NodeDead)
+	expect(t, ev.From, NodeAlive)
+	expect(t, apps[0].router.Route(250, id).ID, 0)
+
+	// Node 1 comes back, node 0 reconnects.
+	FatalIf(t, apps[1].transport.Serve("health-test-1", &RProc{app: apps[1]}))
+	next(NodeAlive)
+	expect(t, apps[0].router.Route(250, id).ID, 1)
+	v, err := procs[0](250)
+	FatalIf(t, err)
+	expect(t, v, opt.intSlice[250])
+	expect(t, apps[0].Stats()[id].Remote, uint64(1))
+}
+
+// A node that accepts connections but never answers.
+func TestDialTimeout(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	FatalIf(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	begin := time.Now()
+	if _, err := dialHTTP(l.Addr().String(), 100*time.Millisecond); err == nil {
+		t.Fatal("expected timeout")
+	}
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Fatalf("dial took %s", d)
+	}
+}
+
+type vector []float64
+
+func TestCodecs(t *testing.T) {
+
+	cases := []struct {
+		codec  string
+		values []Value
+		typ    reflect.Type
+	}{
+		{"gob", []Value{1, 2, 3}, nil},
+		{"json", []Value{[]int{1, 2}, []int{3}}, reflect.TypeOf([]int{})},
+		{"msgpack", []Value{"a", "b"}, reflect.TypeOf("")},
+		{"raw", []Value{-1, 2, 1 << 40}, nil},
+		{"raw", []Value{int8(-3), int8(4)}, nil},
+		{"raw", []Value{[]float32{1.5}, []float32{}, []float32{-2, 3}}, nil},
+		{"raw", []Value{vector{1, 2}, vector{3}}, reflect.TypeOf(vector{})},
+	}
+	for _, tc := range cases {
+		c, ok := LookupCodec(tc.codec)
+		if !ok {
+			t.Fatalf("codec %s not registered", tc.codec)
+		}
+		data, err := c.Encode(tc.values)
+		FatalIf(t, err)
+		values, err := c.Decode(data, len(tc.values), tc.typ)
+		FatalIf(t, err)
+		if !reflect.DeepEqual(values, tc.values) {
+			t.Errorf("%s: got %#v, expected %#v", tc.codec, values, tc.values)
+		}
+	}
+	if _, err := (rawCodec{}).Encode([]Value{1, "a"}); err == nil {
+		t.Error("expected error for mixed types")
+	}
+	if _, err := (rawCodec{}).Decode([]byte{11, 1, 5}, 1, nil); err == nil {
+		t.Error("expected error for short data")
+	}
+
+	data := bytes.Repeat([]byte("occult"), 100)
+	for alg := range compressors {
+		z, err := compress(alg, data)
+		FatalIf(t, err)
+		if len(z) >= len(data) {
+			t.Errorf("%s: compressed %d bytes to %d", alg, len(data), len(z))
+		}
+		got, err := decompress(alg, z)
+		FatalIf(t, err)
+		expect(t, string(got), string(data))
+	}
+}
+
+func TestWireEncoding(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100, Compression: "snappy", CompressThreshold: 100}})
+	ints := AddTypedSource(app, func(c context.Context, idx uint64, ctx *Context) (int, error) {
+		if idx >= uint64(len(opt.intSlice)) {
+			return 0, ErrEndOfArray
+		}
+		return opt.intSlice[idx], nil
+	}, opt)
+	windows := AddTyped(app, func(c context.Context, idx uint64, ctx *Context, in TypedProcessor[int]) ([]int, error) {
+		out := make([]int, 0, opt.winSize)
+		for i := idx * uint64(opt.step); i < idx*uint64(opt.step)+uint64(opt.winSize); i++ {
+			v, err := in.Call(c, i)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}, opt, ints)
+	windows.With(WireCodec("raw"))
+	id := lookup(windows.Processor).id
+	node := pipeNode(t, app, 4)
+
+	var err error
+	node.encoding, err = node.conn.Negotiate(app.encodingOffer())
+	FatalIf(t, err)
+	expect(t, node.encoding.Compression, "snappy")
+
+	// Compressed, the range is larger than the threshold.
+	c := context.Background()
+	sl, err := app.rpCallSlice(c, 0, 10, id, node)
+	FatalIf(t, err)
+	expect(t, sl.Length(), 10)
+	for i, v := range sl.Data {
+		w, err := windows.Get(uint64(i))
+		FatalIf(t, err)
+		if !reflect.DeepEqual(v, w) {
+			t.Fatalf("key %d: got %v, expected %v", i, v, w)
+		}
+	}
+	rs, err := node.conn.Get(&RArgs{Start: 0, End: 10, ProcID: id, Encoding: node.encoding})
+	FatalIf(t, err)
+	expect(t, rs.Codec, "raw")
+	expect(t, rs.Compression, "snappy")
+
+	// Not compressed, gob is used for compression only.
+	rs, err = node.conn.Get(&RArgs{Start: 0, End: 1, ProcID: id, Encoding: node.encoding})
+	FatalIf(t, err)
+	expect(t, rs.Compression, "")
+	rs, err = node.conn.Get(&RArgs{Start: 0, End: 100, ProcID: lookup(ints.Processor).id, Encoding: node.encoding})
+	FatalIf(t, err)
+	expect(t, rs.Codec, "gob")
+
+	slices, errs, err := app.rpCallMulti(c, node, []RArgs{
+		{Start: 15, End: 20, ProcID: id},
+		{Start: 90, End: 110, ProcID: lookup(ints.Processor).id},
+	})
+	FatalIf(t, err)
+	FatalIf(t, errs[0])
+	FatalIf(t, errs[1])
+	expect(t, slices[0].Length(), 4)
+	expect(t, slices[1].Length(), 10)
+	expect(t, slices[1].Data[9], opt.intSlice[99])
+}
+
+func TestTyped(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(1000), winSize: 10, step: 5}
+	config := &Config{App: &App{Name: "test", CacheCap: 100}}
+	app := NewApp(config)
+
+	ints := AddTypedSource(app, func(c context.Context, idx uint64, ctx *Context) (int, error) {
+		if idx >= uint64(len(opt.intSlice)) {
+			return 0, ErrEndOfArray
+		}
+		return opt.intSlice[idx], nil
+	}, opt)
+	windows := AddTyped(app, func(c context.Context, idx uint64, ctx *Context, in TypedProcessor[int]) ([]int, error) {
+		out := make([]int, 0, opt.winSize)
+		for i := idx * uint64(opt.step); i < idx*uint64(opt.step)+uint64(opt.winSize); i++ {
+			v, err := in.Call(c, i)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}, opt, ints)
+	sums := AddTyped2(app, func(c context.Context, idx uint64, ctx *Context, a TypedProcessor[int], b TypedProcessor[[]int]) (int, error) {
+		v, err := a.Call(c, idx)
+		if err != nil {
+			return 0, err
+		}
+		w, err := b.Call(c, idx)
+		if err != nil {
+			return 0, err
+		}
+		return v + w[0], nil
+	}, opt, ints, windows)
+
+	w, err := windows.Get(2)
+	FatalIf(t, err)
+	if !reflect.DeepEqual(w, opt.intSlice[10:20]) {
+		t.Fatalf("wrong window: %v", w)
+	}
+	sum, err := sums.Get(2)
+	FatalIf(t, err)
+	expect(t, sum, opt.intSlice[2]+opt.intSlice[10])
+	_, err = windows.Get(1000)
+	expect(t, err, ErrEndOfArray)
+
+	// Wiring mistakes are detected when the graph is built.
+	if _, err := Typed[string](windows.Processor); err == nil {
+		t.Fatal("expected type error")
+	}
+	p, err := Typed[[]int](windows.Processor)
+	FatalIf(t, err)
+	_, err = p.Get(1)
+	FatalIf(t, err)
+
+	// Untyped processors are checked when values are retrieved.
+	untyped := app.AddSource(randomFunc, opt, nil)
+	q, err := Typed[string](untyped)
+	FatalIf(t, err)
+	if _, err := q.Get(1); err == nil {
+		t.Fatal("expected type error")
+	}
+}
+
+// The deadline reaches the typed sources.
+func TestTypedDeadline(t *testing.T) {
+
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+	slow := AddTypedSource(app, func(c context.Context, idx uint64, ctx *Context) (int, error) {
+		select {
+		case <-time.After(time.Second):
+			return int(idx), nil
+		case <-c.Done():
+			return 0, c.Err()
+		}
+	}, nil)
+	sq := AddTyped(app, func(c context.Context, idx uint64, ctx *Context, in TypedProcessor[int]) (int, error) {
+		v, err := in.Call(c, idx)
+		return v * v, err
+	}, nil, slow)
+
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	_, err := sq.Call(c, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Fatalf("call took %s", d)
+	}
+}
+
+func TestGraph(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5, quant: 4}
+	build := func(name string) *App {
+		app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+		randomInts := app.AddSource(randomFunc, opt, nil).With(Name("ints"))
+		window := app.Add(windowFunc, opt, randomInts).With(Name(name))
+		app.Add(quantileFunc, opt, window)
+		return app
+	}
+	app := build("window")
+
+	g := app.Graph()
+	expect(t, len(g), 3)
+	expect(t, g[0].Name, "ints")
+	expect(t, g[0].Source, true)
+	expect(t, g[0].Options, "*occult.Options")
+	expect(t, g[1].Name, "window")
+	expect(t, g[1].Inputs[0], 0)
+	expect(t, g[2].Name, "")
+	expect(t, g[2].Inputs[0], 1)
+	if app.Proc("window") == nil || app.Proc("foo") != nil {
+		t.Fatal("wrong proc lookup by name")
+	}
+
+	expect(t, g[1].Func, "github.com/akualab/occult.windowFunc")
+	expect(t, g[1].CacheCap, uint64(100))
+
+	app.Proc("window")(2)
+	var b bytes.Buffer
+	FatalIf(t, app.WriteDOT(&b, true))
+	for _, s := range []string{
+		`p0 [label="0: ints\ngithub.com/akualab/occult.randomFunc\ncap: 100\nlen: 10, hits: 0.0%", shape=cylinder];`,
+		`p0 -> p1;`,
+		`p1 -> p2;`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("DOT output is missing %s", s)
+		}
+	}
+	b.Reset()
+	FatalIf(t, app.WriteJSON(&b, false))
+	var out struct{ Procs []ProcInfo }
+	FatalIf(t, json.Unmarshal(b.Bytes(), &out))
+	if !reflect.DeepEqual(out.Procs, g) {
+		t.Errorf("JSON graph mismatch:\n%+v\n%+v", out.Procs, g)
+	}
+
+	expect(t, app.Fingerprint(), build("window").Fingerprint())
+	refute(t, app.Fingerprint(), build("win").Fingerprint())
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for duplicate name")
+		}
+	}()
+	app.Add(sortFunc, opt, app.Proc("window")).With(Name("ints"))
+}
+
+func TestValidate(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	newApp := func() *App {
+		return NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+	}
+	app := newApp()
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	window := app.Add(windowFunc, opt, randomInts)
+	sorted := app.Add(sortFunc, opt, window).With(Name("sorted"))
+	app.Add(sortFunc, opt, func(key uint64) (Value, error) { return nil, nil })
+	FatalIf(t, app.Validate())
+
+	// A graph with a cycle can't be built with Add, wire it by hand.
+	src := lookup(randomInts)
+	src.isSource = false
+	src.inputs = []Processor{sorted}
+	src.resolveInputs()
+	err := app.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cycle in processor graph: 0 <- 2 (sorted) <- 1 <- 0") {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+
+	other := newApp()
+	other.Add(sortFunc, opt, window)
+	other.Add(sortFunc, opt, nil)
+	other.AddSource(randomFunc, opt, window)
+	err = other.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, s := range []string{
+		`processor 0: input 0 belongs to app "test"`,
+		`processor 1: input 0 is nil`,
+		`processor 2: source processors can't have inputs`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error is missing %q: %s", s, err)
+		}
+	}
 }
 
 // func TestChannels(t *testing.T) {
@@ -137,6 +1219,45 @@ func TestQuantiles(t *testing.T) {
 // 	}
 // }
 
+func TestInvalidate(t *testing.T) {
+
+	opt := &Options{intSlice: getRandomInts(100), winSize: 10, step: 5}
+	app := NewApp(&Config{App: &App{Name: "test", CacheCap: 100}})
+	randomInts := app.AddSource(randomFunc, opt, nil)
+	window := app.Add(windowFunc, opt, randomInts)
+	sorted := app.Add(sortFunc, opt, window)
+	other := app.AddSource(randomFunc, opt, nil)
+
+	for k := uint64(0); k < 5; k++ {
+		_, err := sorted(k)
+		FatalIf(t, err)
+		_, err = other(k)
+		FatalIf(t, err)
+	}
+	before := app.Stats()
+	FatalIf(t, app.Invalidate(lookup(randomInts).id, 0, 5))
+	after := app.Stats()
+
+	id := lookup(randomInts).id
+	expect(t, after[id].CacheLen, before[id].CacheLen-5)
+	expect(t, after[id].Invalidated, uint64(5))
+	for _, p := range []Processor{window, sorted} {
+		id := lookup(p).id
+		expect(t, after[id].CacheLen, uint64(0))
+		expect(t, after[id].Invalidated, before[id].CacheLen)
+	}
+	expect(t, after[lookup(other).id].CacheLen, uint64(5))
+
+	// Values are computed again.
+	_, err := sorted(3)
+	FatalIf(t, err)
+	expect(t, app.Stats()[lookup(sorted).id].CacheLen, uint64(1))
+
+	if err := app.Invalidate(10, 0, NoEnd); err == nil {
+		t.Fatal("expected error for unknown processor")
+	}
+}
+
 func TestConfig(t *testing.T) {
 
 	// Prepare dirs.
@@ -163,6 +1284,10 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("Cache capacity is [%s]. Expected [%d]", config.App.CacheCap, 1000)
 	}
 
+	expect(t, config.App.CachePolicy, LFU)
+	expect(t, config.App.Procs["window"].CachePolicy, FIFO)
+	expect(t, config.App.Procs["window"].CacheCap, uint64(50))
+
 	if config.Cluster.Name != "test cluster" {
 		t.Fatalf("Cluster name is [%s]. Expected [%s]", config.Cluster.Name, "test cluster")
 	}
@@ -172,6 +1297,11 @@ const config = `
 app:
   name: "myapp"
   cache_cap: 1000
+  cache_policy: lfu
+  procs:
+    window:
+      cache_policy: fifo
+      cache_cap: 50
 cluster:
   name: "test cluster"
   nodes:
@@ -0,0 +1,790 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A cache eviction policy.
+type CachePolicy string
+
+const (
+	// Evicts the least recently used value. (Default.)
+	LRU CachePolicy = "lru"
+	// Evicts the oldest value, a ring buffer. Good for sliding windows.
+	FIFO CachePolicy = "fifo"
+	// Evicts the least frequently used value.
+	LFU CachePolicy = "lfu"
+	// Never evicts. Good for aggregates that are expensive to compute.
+	Pinned CachePolicy = "pinned"
+	// An LRU cache split in shards with separate locks. Good for
+	// processors used by many workers concurrently.
+	Sharded CachePolicy = "sharded"
+	// A cache set with CustomCache. Can't be used with Policy.
+	Custom CachePolicy = "custom"
+)
+
+// Creates a cache for the policy. An empty policy means LRU.
+func newPolicyCache(policy CachePolicy, capacity uint64) (Cache, error) {
+	switch policy {
+	case LRU, "":
+		return newCache(capacity), nil
+	case FIFO:
+		return newRingCache(capacity), nil
+	case LFU:
+		return newLFUCache(capacity), nil
+	case Pinned:
+		return newPinnedCache(capacity), nil
+	case Sharded:
+		return newShardedCache(capacity), nil
+	}
+	return nil, fmt.Errorf("unknown cache policy %q", policy)
+}
+
+// Sets the eviction policy of the processor cache.
+func Policy(policy CachePolicy) ProcOption {
+	return func(ctx *Context) {
+		_, capacity, _ := ctx.cache.Stats()
+		c, err := newPolicyCache(policy, capacity)
+		if err != nil {
+			panic("occult: " + err.Error())
+		}
+		ctx.setCache(c, policy)
+	}
+}
+
+// Sets a Cache implementation for the processor. The capacity, memory
+// limit and TTL of the processor are applied to c. Use it after the Capacity,
+// MaxBytes and TTL options or change the limits of c after the option.
+func CustomCache(c Cache) ProcOption {
+	return func(ctx *Context) {
+		_, capacity, _ := ctx.cache.Stats()
+		c.SetCapacity(capacity)
+		ctx.setCache(c, Custom)
+	}
+}
+
+// Replaces the processor cache, the settings of the processor are
+// applied to c. The values in the old cache are dropped.
+func (ctx *Context) setCache(c Cache, policy CachePolicy) {
+	c.SetMaxBytes(ctx.maxBytes, ctx.sizer)
+	c.SetTTL(ctx.ttl)
+	if ctx.spill != nil {
+		c.SetEvict(ctx.spill.put)
+	}
+	ctx.cache = c
+	ctx.policy = policy
+}
+
+// Sets the capacity of the processor cache. The capacity manager
+// will not change it.
+func Capacity(capacity uint64) ProcOption {
+	return func(ctx *Context) {
+		ctx.cache.SetCapacity(capacity)
+		ctx.fixedCap = true
+	}
+}
+
+// Per-processor settings in the configuration file. Settings are
+// applied when the processor is named using the Name option. Example:
+//
+//	app:
+//	  cache_policy: lru
+//	  procs:
+//	    agg-cf:
+//	      cache_policy: pinned
+//	    window:
+//	      cache_policy: fifo
+//	      cache_cap: 500
+//	      max_bytes: 1048576
+//	    ratings:
+//	      ttl: 600
+//	    mf:
+//	      spill_bytes: 1073741824
+type ProcConfig struct {
+	CachePolicy CachePolicy `yaml:"cache_policy"`
+	CacheCap    uint64      `yaml:"cache_cap"`
+	MaxBytes    uint64      `yaml:"max_bytes"`
+	// Time to live of the cached values in seconds.
+	TTL int `yaml:"ttl"`
+	// Max size of the spill file. (See Spill.)
+	SpillBytes uint64 `yaml:"spill_bytes"`
+	// Blocks to prefetch for sequential access. (See Prefetch.)
+	Prefetch int `yaml:"prefetch"`
+	// Codec for the values sent to other nodes. (See WireCodec.)
+	Codec string `yaml:"codec"`
+}
+
+// Returns the options for the processor configuration.
+func (pc *ProcConfig) options() []ProcOption {
+	var opts []ProcOption
+	if pc.CachePolicy != "" {
+		opts = append(opts, Policy(pc.CachePolicy))
+	}
+	if pc.CacheCap > 0 {
+		opts = append(opts, Capacity(pc.CacheCap))
+	}
+	if pc.MaxBytes > 0 {
+		opts = append(opts, MaxBytes(pc.MaxBytes))
+	}
+	if pc.TTL > 0 {
+		opts = append(opts, TTL(time.Duration(pc.TTL)*time.Second))
+	}
+	if pc.SpillBytes > 0 {
+		opts = append(opts, Spill(pc.SpillBytes))
+	}
+	if pc.Prefetch > 0 {
+		opts = append(opts, Prefetch(pc.Prefetch))
+	}
+	if pc.Codec != "" {
+		opts = append(opts, WireCodec(pc.Codec))
+	}
+	return opts
+}
+
+// A FIFO cache implemented as a ring buffer.
+type ringCache struct {
+	mu sync.Mutex
+
+	// Entries in insertion order starting at head. Unused slots are nil.
+	ring  []*entry
+	head  int
+	size  int
+	table map[uint64]int // key to ring index
+
+	capacity uint64
+
+	mem   memory
+	ttl   time.Duration
+	evict func(it Item)
+}
+
+func newRingCache(capacity uint64) *ringCache {
+	return &ringCache{
+		ring:     make([]*entry, capacity),
+		table:    make(map[uint64]int),
+		capacity: capacity,
+	}
+}
+
+func (c *ringCache) Get(key uint64) (v Value, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.table[key]
+	if !ok {
+		return nil, false
+	}
+	e := c.ring[i]
+	if e.expired(time.Now()) {
+		c.remove(key)
+		return nil, false
+	}
+	e.time_accessed = time.Now()
+	return e.value, true
+}
+
+func (c *ringCache) GetSlice(start uint64, size int) (sl *Slice) {
+	return getSlice(c, start, size)
+}
+
+func (c *ringCache) Set(key uint64, value Value) {
+	size := c.mem.sizeOf(value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i, ok := c.table[key]; ok {
+		c.mem.update(c.ring[i], value, size)
+		c.ring[i].time_accessed = time.Now()
+		c.ring[i].expires = expiration(c.ttl)
+		c.checkMemory()
+		return
+	}
+	if c.capacity == 0 {
+		return
+	}
+	if uint64(c.size) == c.capacity {
+		c.pop() // overwrite the oldest entry
+	}
+	e := &entry{key: key, value: value, time_accessed: time.Now(), expires: expiration(c.ttl)}
+	c.push(e)
+	c.mem.add(e, size)
+	c.checkMemory()
+}
+
+func (c *ringCache) SetSlice(start uint64, sl *Slice) {
+	setSlice(c, start, sl)
+}
+
+func (c *ringCache) Delete(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.table[key]; !ok {
+		return false
+	}
+	c.remove(key)
+	return true
+}
+
+// Removes an entry that is in the cache. Compacts the ring to preserve the order.
+func (c *ringCache) remove(key uint64) {
+	entries := c.entries()
+	c.reset(len(c.ring))
+	for _, e := range entries {
+		if e.key != key {
+			c.push(e)
+		} else {
+			c.mem.remove(e)
+		}
+	}
+}
+
+func (c *ringCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reset(len(c.ring))
+	c.mem.bytes = 0
+}
+
+func (c *ringCache) SetCapacity(capacity uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries()
+	if uint64(len(entries)) > capacity {
+		n := uint64(len(entries)) - capacity
+		for _, e := range entries[:n] {
+			c.mem.remove(e)
+			if c.evict != nil {
+				c.evict(e.item())
+			}
+		}
+		entries = entries[n:] // keep the newest
+	}
+	c.capacity = capacity
+	c.reset(int(capacity))
+	for _, e := range entries {
+		c.push(e)
+	}
+}
+
+func (c *ringCache) SetMaxBytes(maxBytes uint64, sizer Sizer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem.set(maxBytes, sizer, c.entries())
+	c.checkMemory()
+}
+
+func (c *ringCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+func (c *ringCache) SetExpires(key uint64, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i, ok := c.table[key]; ok {
+		c.ring[i].expires = expires
+	}
+}
+
+func (c *ringCache) SetEvict(fn func(it Item)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict = fn
+}
+
+func (c *ringCache) Usage() (bytes, maxBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.bytes, c.mem.maxBytes
+}
+
+func (c *ringCache) Stats() (length, capacity uint64, oldest time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries() {
+		if oldest.IsZero() || e.time_accessed.Before(oldest) {
+			oldest = e.time_accessed
+		}
+	}
+	return uint64(c.size), c.capacity, oldest
+}
+
+func (c *ringCache) Keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]uint64, 0, c.size)
+	for _, e := range c.entries() {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+func (c *ringCache) Items() []Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.entries()
+	items := make([]Item, 0, c.size)
+	for i := len(entries) - 1; i >= 0; i-- {
+		items = append(items, Item{Key: entries[i].key, Value: entries[i].value, Expires: entries[i].expires})
+	}
+	return items
+}
+
+// Entries from oldest to newest.
+func (c *ringCache) entries() []*entry {
+	entries := make([]*entry, 0, c.size)
+	for k := 0; k < c.size; k++ {
+		entries = append(entries, c.ring[(c.head+k)%len(c.ring)])
+	}
+	return entries
+}
+
+func (c *ringCache) reset(n int) {
+	c.ring = make([]*entry, n)
+	c.head = 0
+	c.size = 0
+	c.table = make(map[uint64]int)
+}
+
+// Appends an entry, the ring must have space.
+func (c *ringCache) push(e *entry) {
+	i := (c.head + c.size) % len(c.ring)
+	c.ring[i] = e
+	c.table[e.key] = i
+	c.size++
+}
+
+// Removes the oldest entry.
+func (c *ringCache) pop() {
+	e := c.ring[c.head]
+	delete(c.table, e.key)
+	c.ring[c.head] = nil
+	c.head = (c.head + 1) % len(c.ring)
+	c.size--
+	c.mem.remove(e)
+	if c.evict != nil {
+		c.evict(e.item())
+	}
+}
+
+// Evicts the oldest entries until the memory limit is met.
+func (c *ringCache) checkMemory() {
+	for c.mem.over() && c.size > 0 {
+		c.pop()
+	}
+}
+
+// An LFU cache. Ties are broken by evicting the least recently used entry.
+type lfuCache struct {
+	mu sync.Mutex
+
+	heap  lfuHeap
+	table map[uint64]*lfuEntry
+	tick  uint64
+
+	capacity uint64
+
+	mem   memory
+	ttl   time.Duration
+	evict func(it Item)
+}
+
+type lfuEntry struct {
+	entry
+	freq  uint64
+	tick  uint64 // last access
+	index int    // heap index
+}
+
+// A min-heap of entries ordered by frequency and last access.
+type lfuHeap []*lfuEntry
+
+// Returns true if e would be evicted before o.
+func (e *lfuEntry) before(o *lfuEntry) bool {
+	if e.freq != o.freq {
+		return e.freq < o.freq
+	}
+	return e.tick < o.tick
+}
+
+func (h lfuHeap) Len() int           { return len(h) }
+func (h lfuHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+func newLFUCache(capacity uint64) *lfuCache {
+	return &lfuCache{
+		table:    make(map[uint64]*lfuEntry),
+		capacity: capacity,
+	}
+}
+
+func (c *lfuCache) Get(key uint64) (v Value, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.table[key]
+	if e == nil {
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		c.remove(e)
+		return nil, false
+	}
+	c.touch(e)
+	return e.value, true
+}
+
+func (c *lfuCache) GetSlice(start uint64, size int) (sl *Slice) {
+	return getSlice(c, start, size)
+}
+
+func (c *lfuCache) Set(key uint64, value Value) {
+	size := c.mem.sizeOf(value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.table[key]; e != nil {
+		c.mem.update(&e.entry, value, size)
+		e.expires = expiration(c.ttl)
+		c.touch(e)
+		c.checkCapacity()
+		return
+	}
+	e := &lfuEntry{entry: entry{key: key, value: value, time_accessed: time.Now(), expires: expiration(c.ttl)}}
+	c.table[key] = e
+	heap.Push(&c.heap, e)
+	c.mem.add(&e.entry, size)
+	c.touch(e)
+	c.checkCapacity()
+}
+
+func (c *lfuCache) SetSlice(start uint64, sl *Slice) {
+	setSlice(c, start, sl)
+}
+
+func (c *lfuCache) Delete(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.table[key]
+	if e == nil {
+		return false
+	}
+	c.remove(e)
+	return true
+}
+
+func (c *lfuCache) remove(e *lfuEntry) {
+	heap.Remove(&c.heap, e.index)
+	delete(c.table, e.key)
+	c.mem.remove(&e.entry)
+}
+
+func (c *lfuCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.heap = nil
+	c.table = make(map[uint64]*lfuEntry)
+	c.mem.bytes = 0
+}
+
+func (c *lfuCache) SetCapacity(capacity uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.checkCapacity()
+}
+
+func (c *lfuCache) SetMaxBytes(maxBytes uint64, sizer Sizer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*entry, 0, len(c.heap))
+	for _, e := range c.heap {
+		entries = append(entries, &e.entry)
+	}
+	c.mem.set(maxBytes, sizer, entries)
+	c.checkCapacity()
+}
+
+func (c *lfuCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+func (c *lfuCache) SetExpires(key uint64, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.table[key]; ok {
+		e.expires = expires
+	}
+}
+
+func (c *lfuCache) SetEvict(fn func(it Item)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict = fn
+}
+
+func (c *lfuCache) Usage() (bytes, maxBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.bytes, c.mem.maxBytes
+}
+
+func (c *lfuCache) Stats() (length, capacity uint64, oldest time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.heap {
+		if oldest.IsZero() || e.time_accessed.Before(oldest) {
+			oldest = e.time_accessed
+		}
+	}
+	return uint64(len(c.heap)), c.capacity, oldest
+}
+
+func (c *lfuCache) Keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]uint64, 0, len(c.heap))
+	for _, e := range c.heap {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+func (c *lfuCache) Items() []Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(lfuHeap, len(c.heap))
+	copy(entries, c.heap)
+	sort.Slice(entries, func(i, j int) bool { return entries[j].before(entries[i]) })
+	items := make([]Item, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, Item{Key: e.key, Value: e.value, Expires: e.expires})
+	}
+	return items
+}
+
+func (c *lfuCache) touch(e *lfuEntry) {
+	c.tick++
+	e.freq++
+	e.tick = c.tick
+	e.time_accessed = time.Now()
+	heap.Fix(&c.heap, e.index)
+}
+
+func (c *lfuCache) checkCapacity() {
+	for uint64(len(c.heap)) > c.capacity || (c.mem.over() && len(c.heap) > 0) {
+		e := heap.Pop(&c.heap).(*lfuEntry)
+		delete(c.table, e.key)
+		c.mem.remove(&e.entry)
+		if c.evict != nil {
+			c.evict(e.item())
+		}
+	}
+}
+
+// A cache that never evicts. The capacity and the memory limit are
+// reported but not enforced. Values still expire if there is a TTL.
+type pinnedCache struct {
+	mu       sync.Mutex
+	table    map[uint64]*entry
+	capacity uint64
+	mem      memory
+	ttl      time.Duration
+}
+
+func newPinnedCache(capacity uint64) *pinnedCache {
+	return &pinnedCache{
+		table:    make(map[uint64]*entry),
+		capacity: capacity,
+	}
+}
+
+func (c *pinnedCache) Get(key uint64) (v Value, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.table[key]
+	if e == nil {
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		delete(c.table, key)
+		c.mem.remove(e)
+		return nil, false
+	}
+	e.time_accessed = time.Now()
+	return e.value, true
+}
+
+func (c *pinnedCache) GetSlice(start uint64, size int) (sl *Slice) {
+	return getSlice(c, start, size)
+}
+
+func (c *pinnedCache) Set(key uint64, value Value) {
+	size := c.mem.sizeOf(value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.table[key]; e != nil {
+		c.mem.update(e, value, size)
+		e.time_accessed = time.Now()
+		e.expires = expiration(c.ttl)
+		return
+	}
+	e := &entry{key: key, value: value, time_accessed: time.Now(), expires: expiration(c.ttl)}
+	c.table[key] = e
+	c.mem.add(e, size)
+}
+
+func (c *pinnedCache) SetSlice(start uint64, sl *Slice) {
+	setSlice(c, start, sl)
+}
+
+func (c *pinnedCache) Delete(key uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.table[key]
+	if ok {
+		delete(c.table, key)
+		c.mem.remove(e)
+	}
+	return ok
+}
+
+func (c *pinnedCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.table = make(map[uint64]*entry)
+	c.mem.bytes = 0
+}
+
+func (c *pinnedCache) SetCapacity(capacity uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+}
+
+func (c *pinnedCache) SetMaxBytes(maxBytes uint64, sizer Sizer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*entry, 0, len(c.table))
+	for _, e := range c.table {
+		entries = append(entries, e)
+	}
+	c.mem.set(maxBytes, sizer, entries)
+}
+
+func (c *pinnedCache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+}
+
+// Nothing is evicted.
+func (c *pinnedCache) SetExpires(key uint64, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.table[key]; ok {
+		e.expires = expires
+	}
+}
+
+func (c *pinnedCache) SetEvict(fn func(it Item)) {}
+
+func (c *pinnedCache) Usage() (bytes, maxBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.bytes, c.mem.maxBytes
+}
+
+func (c *pinnedCache) Stats() (length, capacity uint64, oldest time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.table {
+		if oldest.IsZero() || e.time_accessed.Before(oldest) {
+			oldest = e.time_accessed
+		}
+	}
+	return uint64(len(c.table)), c.capacity, oldest
+}
+
+func (c *pinnedCache) Keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]uint64, 0, len(c.table))
+	for k := range c.table {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (c *pinnedCache) Items() []Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := make([]Item, 0, len(c.table))
+	for _, e := range c.table {
+		items = append(items, Item{Key: e.key, Value: e.value, Expires: e.expires})
+	}
+	return items
+}
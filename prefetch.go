@@ -0,0 +1,130 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// Number of consecutive keys that start prefetching.
+const sequentialRun = 3
+
+// Detects sequential access to a processor and fetches the next blocks
+// in the background, from the local processor or from remote nodes. The
+// values are saved in the cache, so the cache must be large enough to hold
+// the prefetched blocks and the working set. Only one sequence of keys is
+// tracked, keys requested out of order by concurrent callers (such as the
+// Map workers) don't start prefetching. Prefetching stops on Shutdown.
+type prefetcher struct {
+	mu     sync.Mutex
+	app    *App
+	ctx    *Context
+	blocks uint64 // blocks to fetch ahead
+	last   uint64 // last key requested
+	run    int    // consecutive keys requested
+	next   uint64 // first block not prefetched
+	busy   bool   // a prefetch is running
+}
+
+// Fetches the next blocks if the last keys were requested in order. At most
+// one prefetch runs at a time for a processor.
+func (p *prefetcher) observe(key uint64) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch key {
+	case p.last + 1:
+		p.run++
+	case p.last:
+	default:
+		p.run = 0
+		p.next = 0
+	}
+	p.last = key
+	if p.run < sequentialRun || p.busy {
+		return
+	}
+	bs := p.app.BlockSize
+	first := key/bs + 1
+	if p.next > first {
+		first = p.next
+	}
+	end := key/bs + 1 + p.blocks
+	if first >= end {
+		return
+	}
+	p.next = end
+	p.busy = true
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.busy = false
+			p.mu.Unlock()
+		}()
+		for b := first; b < end; b++ {
+			if !p.fetch(b * bs) {
+				return
+			}
+		}
+	}()
+}
+
+// Fetches the block that starts at key start. Returns false if the block
+// could not be fetched, is the last block or the app is shut down.
+func (p *prefetcher) fetch(start uint64) bool {
+
+	app, ctx := p.app, p.ctx
+	c := app.root
+	if c.Err() != nil {
+		return false
+	}
+	defer ctx.flushSpill()
+	size := app.BlockSize
+	if app.cluster != nil {
+		node := app.router.Route(start, ctx.id)
+		if node.ID != app.cluster.NodeID {
+			if sl := ctx.cache.GetSlice(start, int(size)); uint64(sl.Length()) == size {
+				return true
+			}
+			vals, err := app.fetchBlock(c, ctx, start, node)
+			if err != nil {
+				glog.V(4).Infof("prefetch of block %d for proc %d failed: %s", start, ctx.id, err)
+				return false
+			}
+			atomic.AddUint64(&ctx.stats.numPrefetched, uint64(vals.Length()))
+			return uint64(vals.Length()) == size
+		}
+	}
+	for key := start; key < start+size; key++ {
+		if _, ok := ctx.cache.Get(key); ok {
+			continue
+		}
+		if _, err := app.computeLocal(c, ctx, key); err != nil {
+			if err != ErrEndOfArray {
+				glog.V(4).Infof("prefetch of key %d for proc %d failed: %s", key, ctx.id, err)
+			}
+			return false
+		}
+		atomic.AddUint64(&ctx.stats.numPrefetched, 1)
+	}
+	return true
+}
+
+// Prefetches the next n blocks when the processor keys are requested
+// in order. Zero disables prefetching.
+func Prefetch(n int) ProcOption {
+	return func(ctx *Context) {
+		if n <= 0 {
+			ctx.prefetch = nil
+			return
+		}
+		ctx.prefetch = &prefetcher{app: ctx.app, ctx: ctx, blocks: uint64(n)}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Numeric types supported by the raw codec. The index is sent on the
+// wire, append new types at the end.
+var rawTypes = []reflect.Type{
+	reflect.TypeOf(int(0)),
+	reflect.TypeOf(int8(0)),
+	reflect.TypeOf(int16(0)),
+	reflect.TypeOf(int32(0)),
+	reflect.TypeOf(int64(0)),
+	reflect.TypeOf(uint(0)),
+	reflect.TypeOf(uint8(0)),
+	reflect.TypeOf(uint16(0)),
+	reflect.TypeOf(uint32(0)),
+	reflect.TypeOf(uint64(0)),
+	reflect.TypeOf(float32(0)),
+	reflect.TypeOf(float64(0)),
+}
+
+var errRawShort = errors.New("raw data is too short")
+
+// Encodes numbers or slices of numbers as little-endian arrays. All the
+// values must have the same type. The data starts with the index of the
+// element type and a flag that is 1 for slices, followed by the values.
+// Each slice is preceded by its length. Int and uint use 8 bytes.
+// Values of named types, like a Factor type defined as []float64, are
+// converted back for typed processors.
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return "raw" }
+
+func (rawCodec) Encode(values []Value) ([]byte, error) {
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+	t := reflect.TypeOf(values[0])
+	if t == nil {
+		return nil, fmt.Errorf("can't encode nil value")
+	}
+	isSlice := t.Kind() == reflect.Slice
+	elem := t
+	if isSlice {
+		elem = t.Elem()
+	}
+	idx := rawIndex(elem.Kind())
+	if idx < 0 {
+		return nil, fmt.Errorf("can't encode values of type %s", t)
+	}
+	size := rawSize(elem.Kind())
+	b := []byte{byte(idx), 0}
+	if isSlice {
+		b[1] = 1
+	}
+	for i, v := range values {
+		rv := reflect.ValueOf(v)
+		if rv.Type() != t {
+			return nil, fmt.Errorf("value %d has type %T, expected %s", i, v, t)
+		}
+		if !isSlice {
+			b = appendRaw(b, rv, size)
+			continue
+		}
+		b = binary.AppendUvarint(b, uint64(rv.Len()))
+		for j := 0; j < rv.Len(); j++ {
+			b = appendRaw(b, rv.Index(j), size)
+		}
+	}
+	return b, nil
+}
+
+func (rawCodec) Decode(data []byte, n int, typ reflect.Type) ([]Value, error) {
+
+	values := make([]Value, n)
+	if n == 0 {
+		return values, nil
+	}
+	if len(data) < 2 || int(data[0]) >= len(rawTypes) {
+		return nil, errRawShort
+	}
+	elem := rawTypes[data[0]]
+	isSlice := data[1] == 1
+	size := rawSize(elem.Kind())
+	data = data[2:]
+	for i := range values {
+		var rv reflect.Value
+		if !isSlice {
+			if len(data) < size {
+				return nil, errRawShort
+			}
+			rv = reflect.New(elem).Elem()
+			setRaw(rv, data, size)
+			data = data[size:]
+		} else {
+			l, k := binary.Uvarint(data)
+			if k <= 0 || l > uint64(len(data)) || uint64(len(data)-k) < l*uint64(size) {
+				return nil, errRawShort
+			}
+			data = data[k:]
+			rv = reflect.MakeSlice(reflect.SliceOf(elem), int(l), int(l))
+			for j := 0; j < int(l); j++ {
+				setRaw(rv.Index(j), data, size)
+				data = data[size:]
+			}
+		}
+		if typ != nil && rv.Type() != typ && rv.Type().ConvertibleTo(typ) {
+			rv = rv.Convert(typ)
+		}
+		values[i] = rv.Interface()
+	}
+	return values, nil
+}
+
+// Returns the index of kind in rawTypes, -1 if not supported.
+func rawIndex(kind reflect.Kind) int {
+	for i, t := range rawTypes {
+		if t.Kind() == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+func rawSize(kind reflect.Kind) int {
+	switch kind {
+	case reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	}
+	return 8
+}
+
+func appendRaw(b []byte, v reflect.Value, size int) []byte {
+	var u uint64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u = uint64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u = v.Uint()
+	case reflect.Float32:
+		u = uint64(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		u = math.Float64bits(v.Float())
+	}
+	switch size {
+	case 1:
+		return append(b, byte(u))
+	case 2:
+		return binary.LittleEndian.AppendUint16(b, uint16(u))
+	case 4:
+		return binary.LittleEndian.AppendUint32(b, uint32(u))
+	}
+	return binary.LittleEndian.AppendUint64(b, u)
+}
+
+func setRaw(v reflect.Value, b []byte, size int) {
+	var u uint64
+	switch size {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		u = uint64(binary.LittleEndian.Uint32(b))
+	default:
+		u = binary.LittleEndian.Uint64(b)
+	}
+	switch v.Kind() {
+	case reflect.Int8:
+		v.SetInt(int64(int8(u)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(u)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(u)))
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(u))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(u)
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(uint32(u))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(u))
+	}
+}
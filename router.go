@@ -1,5 +1,10 @@
 package occult
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 // A router identifies which remote node can do the
 // requested work efficiently for a given processor
 // instance and range of keys.
@@ -8,6 +13,9 @@ type Router interface {
 	Route(key uint64, procID int) *Node
 	// Target node for processor slice.
 	RouteSlice(start, end uint64, procID int) *Node
+	// Marks node id as suspect until the given time. The work for a
+	// suspect node is sent to other nodes. A zero time clears the mark.
+	Suspect(id int, until time.Time)
 }
 
 // A router implementation that always route to the same node.
@@ -21,19 +29,59 @@ func (r *simpleRouter) RouteSlice(start, end uint64, procID int) *Node {
 	return &Node{ID: 0}
 }
 
+func (r *simpleRouter) Suspect(id int, until time.Time) {}
+
 // A router implementation that assigns nodes based on key ranges.
 // Not for practical use but useful to start testing.
 type blockRouter struct {
 	numNodes  int
 	blockSize uint64
 	cluster   *Cluster
+	// Unix time in nanoseconds until which each node is suspect.
+	suspects []atomic.Int64
+}
+
+func newBlockRouter(cluster *Cluster, blockSize uint64) *blockRouter {
+	return &blockRouter{
+		numNodes:  len(cluster.Nodes),
+		blockSize: blockSize,
+		cluster:   cluster,
+		suspects:  make([]atomic.Int64, len(cluster.Nodes)),
+	}
 }
 
+// Keys of a suspect node go to the next node that is not suspect.
+// The local node is never suspect.
 func (r *blockRouter) Route(key uint64, procID int) *Node {
 	block := int(key / r.blockSize)
-	return r.cluster.Node(block % r.numNodes)
+	for i := 0; i < r.numNodes; i++ {
+		node := r.cluster.Node((block + i) % r.numNodes)
+		if node.ID == r.cluster.NodeID || !r.isSuspect(node.ID) {
+			return node
+		}
+	}
+	return r.cluster.LocalNode()
 }
 
 func (r *blockRouter) RouteSlice(start, end uint64, procID int) *Node {
 	return r.Route(start, procID)
 }
+
+func (r *blockRouter) Suspect(id int, until time.Time) {
+	if id < 0 || id >= len(r.suspects) {
+		return
+	}
+	if until.IsZero() {
+		r.suspects[id].Store(0)
+		return
+	}
+	r.suspects[id].Store(until.UnixNano())
+}
+
+func (r *blockRouter) isSuspect(id int) bool {
+	if id < 0 || id >= len(r.suspects) {
+		return false
+	}
+	until := r.suspects[id].Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
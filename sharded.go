@@ -0,0 +1,214 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Number of shards in a sharded cache.
+const numShards = 16
+
+// An LRU cache split in shards, each with its own lock, to reduce lock
+// contention when many workers use the cache. Keys are assigned to shards
+// by hash so consecutive keys are in different shards. The capacity and the
+// memory limit are split equally among the shards, rounded up, so the
+// eviction order is approximate.
+type shardedCache struct {
+	shards   [numShards]*cache
+	capacity uint64
+}
+
+func newShardedCache(capacity uint64) *shardedCache {
+	c := &shardedCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = newCache(shardShare(capacity))
+	}
+	return c
+}
+
+// Returns the share of n for a shard, rounded up.
+func shardShare(n uint64) uint64 {
+	return (n + numShards - 1) / numShards
+}
+
+// Returns the shard of a key. (Uses the MurmurHash3 finalizer.)
+func shardIndex(key uint64) int {
+	key ^= key >> 33
+	key *= 0xff51afd7ed558ccd
+	key ^= key >> 33
+	key *= 0xc4ceb9fe1a85ec53
+	key ^= key >> 33
+	return int(key % numShards)
+}
+
+func (c *shardedCache) shard(key uint64) *cache {
+	return c.shards[shardIndex(key)]
+}
+
+// Groups the offsets of the keys {start..start+size-1} by shard. The
+// offsets for shard i are order[bounds[i]:bounds[i+1]], in ascending order.
+func shardOffsets(start uint64, size int) (order []int, bounds [numShards + 1]int) {
+	shards := make([]uint8, size)
+	for k := range shards {
+		shards[k] = uint8(shardIndex(start + uint64(k)))
+		bounds[shards[k]+1]++
+	}
+	for i := 1; i <= numShards; i++ {
+		bounds[i] += bounds[i-1]
+	}
+	order = make([]int, size)
+	next := bounds
+	for k, i := range shards {
+		order[next[i]] = k
+		next[i]++
+	}
+	return
+}
+
+func (c *shardedCache) Get(key uint64) (v Value, ok bool) {
+	return c.shard(key).Get(key)
+}
+
+// Takes each shard lock once.
+func (c *shardedCache) GetSlice(start uint64, size int) (sl *Slice) {
+	vals := make([]Value, size)
+	n := size // values before the first missing key
+	order, bounds := shardOffsets(start, size)
+	for i := 0; i < numShards; i++ {
+		offsets := order[bounds[i]:bounds[i+1]]
+		if len(offsets) == 0 || offsets[0] >= n {
+			continue
+		}
+		s := c.shards[i]
+		s.mu.Lock()
+		for _, k := range offsets {
+			if k >= n {
+				break
+			}
+			v, ok := s.getLocked(start + uint64(k))
+			if !ok {
+				n = k
+				break
+			}
+			vals[k] = v
+		}
+		s.mu.Unlock()
+	}
+	sl = NewSlice(start, 0, n)
+	sl.Data = append(sl.Data, vals[:n]...)
+	return
+}
+
+func (c *shardedCache) Set(key uint64, value Value) {
+	c.shard(key).Set(key, value)
+}
+
+// Takes each shard lock once.
+func (c *shardedCache) SetSlice(start uint64, sl *Slice) {
+	order, bounds := shardOffsets(start, len(sl.Data))
+	for i := 0; i < numShards; i++ {
+		offsets := order[bounds[i]:bounds[i+1]]
+		if len(offsets) == 0 {
+			continue
+		}
+		s := c.shards[i]
+		sizes := make([]int, len(offsets))
+		for j, k := range offsets {
+			sizes[j] = s.mem.sizeOf(sl.Data[k])
+		}
+		s.mu.Lock()
+		for j, k := range offsets {
+			s.setLocked(start+uint64(k), sl.Data[k], sizes[j])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (c *shardedCache) Delete(key uint64) bool {
+	return c.shard(key).Delete(key)
+}
+
+func (c *shardedCache) Clear() {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+}
+
+func (c *shardedCache) SetCapacity(capacity uint64) {
+	atomic.StoreUint64(&c.capacity, capacity)
+	for _, s := range c.shards {
+		s.SetCapacity(shardShare(capacity))
+	}
+}
+
+func (c *shardedCache) SetMaxBytes(maxBytes uint64, sizer Sizer) {
+	for _, s := range c.shards {
+		s.SetMaxBytes(shardShare(maxBytes), sizer)
+	}
+}
+
+func (c *shardedCache) SetTTL(ttl time.Duration) {
+	for _, s := range c.shards {
+		s.SetTTL(ttl)
+	}
+}
+
+func (c *shardedCache) SetExpires(key uint64, expires time.Time) {
+	c.shard(key).SetExpires(key, expires)
+}
+
+func (c *shardedCache) SetEvict(fn func(it Item)) {
+	for _, s := range c.shards {
+		s.SetEvict(fn)
+	}
+}
+
+func (c *shardedCache) Stats() (length, capacity uint64, oldest time.Time) {
+	for _, s := range c.shards {
+		l, _, o := s.Stats()
+		length += l
+		if !o.IsZero() && (oldest.IsZero() || o.Before(oldest)) {
+			oldest = o
+		}
+	}
+	return length, atomic.LoadUint64(&c.capacity), oldest
+}
+
+func (c *shardedCache) Usage() (bytes, maxBytes uint64) {
+	for _, s := range c.shards {
+		b, m := s.Usage()
+		bytes += b
+		maxBytes += m
+	}
+	return
+}
+
+func (c *shardedCache) Keys() []uint64 {
+	var keys []uint64
+	for _, s := range c.shards {
+		keys = append(keys, s.Keys()...)
+	}
+	return keys
+}
+
+// Merges the shards by access time so the item evicted last is first.
+func (c *shardedCache) Items() []Item {
+	var entries []entry
+	for _, s := range c.shards {
+		entries = append(entries, s.entries()...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time_accessed.After(entries[j].time_accessed)
+	})
+	items := make([]Item, len(entries))
+	for i, e := range entries {
+		items[i] = Item{Key: e.key, Value: e.value, Expires: e.expires}
+	}
+	return items
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Cache snapshots let a node restart with warm caches. Each processor cache
+// is saved to a file named after the processor. A snapshot can only be
+// loaded by an app with the same graph fingerprint. Values must be
+// registered with gob. (See gob.Register.)
+
+// The first record in a snapshot file, followed by NumItems items.
+type snapshotHeader struct {
+	App         string
+	Fingerprint string
+	ProcID      int
+	Name        string
+	Time        time.Time
+	NumItems    int
+}
+
+// Returns the name of the snapshot file for a processor. The name is
+// escaped so the file is always in dir.
+func (ctx *Context) snapshotFile(dir string) string {
+	name := ctx.name
+	if name == "" {
+		name = fmt.Sprintf("proc-%d", ctx.id)
+	}
+	return filepath.Join(dir, url.PathEscape(name)+".cache")
+}
+
+// Saves the cache of every processor to a file in dir. The directory is
+// created if needed. Processors that can't be saved are reported in the
+// error and skipped.
+func (app *App) SaveCache(dir string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fp := app.Fingerprint()
+	var errs []error
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		n, err := ctx.saveCache(dir, fp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proc %d: %w", id, err))
+			continue
+		}
+		glog.V(2).Infof("saved %d values of proc %d to %s", n, id, ctx.snapshotFile(dir))
+	}
+	return errors.Join(errs...)
+}
+
+// Writes the cache to a temporary file and renames it so an
+// existing snapshot is not corrupted if the save fails.
+func (ctx *Context) saveCache(dir, fp string) (n int, err error) {
+
+	f, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	items := ctx.cache.Items()
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	hdr := &snapshotHeader{
+		App:         ctx.app.Name,
+		Fingerprint: fp,
+		ProcID:      ctx.id,
+		Name:        ctx.name,
+		Time:        time.Now(),
+		NumItems:    len(items),
+	}
+	if err = enc.Encode(hdr); err != nil {
+		return 0, err
+	}
+	for _, it := range items {
+		if err = enc.Encode(&it); err != nil {
+			return 0, fmt.Errorf("can't encode value for key %d: %w", it.Key, err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	return len(items), os.Rename(f.Name(), ctx.snapshotFile(dir))
+}
+
+// Loads the caches saved by SaveCache in dir. Processors without a
+// snapshot are skipped. Snapshots saved by an app with a different
+// graph fingerprint are rejected.
+func (app *App) LoadCache(dir string) error {
+
+	fp := app.Fingerprint()
+	var errs []error
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		n, err := ctx.loadCache(dir, fp)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proc %d: %w", id, err))
+			continue
+		}
+		glog.V(2).Infof("loaded %d values of proc %d from %s", n, id, ctx.snapshotFile(dir))
+	}
+	return errors.Join(errs...)
+}
+
+func (ctx *Context) loadCache(dir, fp string) (int, error) {
+
+	f, err := os.Open(ctx.snapshotFile(dir))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var hdr snapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return 0, err
+	}
+	if hdr.Fingerprint != fp {
+		return 0, fmt.Errorf("snapshot %s has graph fingerprint %s, expected %s",
+			f.Name(), hdr.Fingerprint, fp)
+	}
+	items := make([]Item, hdr.NumItems)
+	for i := range items {
+		if err := dec.Decode(&items[i]); err != nil {
+			return 0, err
+		}
+	}
+	// The item to be evicted last goes last. Expired items are skipped,
+	// the others keep their expiration time.
+	now := time.Now()
+	n := 0
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		if !it.Expires.IsZero() && now.After(it.Expires) {
+			continue
+		}
+		ctx.cache.Set(it.Key, it.Value)
+		if !it.Expires.IsZero() {
+			ctx.cache.SetExpires(it.Key, it.Expires)
+		}
+		n++
+	}
+	ctx.flushSpill()
+	return n, nil
+}
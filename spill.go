@@ -0,0 +1,358 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A second level cache on the local disk. Values evicted from the processor
+// cache are appended to a file and looked up before computing them again.
+// The file is deleted when the app shuts down. Values must be registered
+// with gob. (See gob.Register.)
+type diskCache struct {
+	mu sync.Mutex
+
+	f      *os.File
+	closed bool
+	index  map[uint64]diskEntry
+	// Size of the file and of the live records in bytes.
+	size, live int64
+	maxBytes   int64
+
+	// Evicted entries waiting to be written by flush. Guarded by qmu
+	// which put takes with the processor cache lock held. Take mu
+	// first when both are needed.
+	qmu     sync.Mutex
+	pending map[uint64]*entry
+
+	numHits, numWrites uint64
+}
+
+// The location of a value in the file.
+type diskEntry struct {
+	offset  int64
+	length  int
+	expires time.Time
+}
+
+// Creates a file for the processor in dir. Uses the default
+// temporary directory if dir is empty. The app name is escaped.
+func newDiskCache(dir string, ctx *Context, maxBytes int64) (*diskCache, error) {
+	pattern := fmt.Sprintf("occult-%s-%d-*.spill", url.PathEscape(ctx.app.Name), ctx.id)
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("spilling proc %d to %s, max bytes: %d", ctx.id, f.Name(), maxBytes)
+	return &diskCache{
+		f:        f,
+		index:    make(map[uint64]diskEntry),
+		pending:  make(map[uint64]*entry),
+		maxBytes: maxBytes,
+	}, nil
+}
+
+// Queues an evicted entry, flush writes it to the file. Expired entries
+// are dropped. Called by the processor cache with its lock held.
+func (d *diskCache) put(it Item) {
+	e := &entry{key: it.Key, value: it.Value, expires: it.Expires}
+	if e.expired(time.Now()) {
+		return
+	}
+	d.qmu.Lock()
+	defer d.qmu.Unlock()
+	d.pending[e.key] = e
+}
+
+// Writes the queued entries. Values that can't be encoded are dropped.
+// Called without the processor cache lock.
+func (d *diskCache) flush() {
+	d.qmu.Lock()
+	queue := make([]*entry, 0, len(d.pending))
+	for _, e := range d.pending {
+		queue = append(queue, e)
+	}
+	d.qmu.Unlock()
+
+	for _, e := range queue {
+		var buf bytes.Buffer
+		v := e.value
+		if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+			glog.V(4).Infof("can't spill value of type %T: %s", e.value, err)
+			d.qmu.Lock()
+			d.dequeue(e)
+			d.qmu.Unlock()
+			continue
+		}
+		d.write(e, buf.Bytes())
+	}
+}
+
+// Writes an encoded entry unless it was removed from the queue.
+func (d *diskCache) write(e *entry, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.qmu.Lock()
+	queued := d.dequeue(e)
+	d.qmu.Unlock()
+	if !queued {
+		return // read, deleted or queued again.
+	}
+	d.remove(e.key)
+	n := int64(len(data))
+	if d.closed || n > d.maxBytes {
+		return
+	}
+	if d.size+n > d.maxBytes {
+		if err := d.compact(d.maxBytes - n); err != nil {
+			glog.Errorf("can't compact spill file %s: %s", d.f.Name(), err)
+			return
+		}
+	}
+	if _, err := d.f.WriteAt(data, d.size); err != nil {
+		glog.Errorf("can't write to spill file %s: %s", d.f.Name(), err)
+		return
+	}
+	d.index[e.key] = diskEntry{offset: d.size, length: len(data), expires: e.expires}
+	d.size += n
+	d.live += n
+	atomic.AddUint64(&d.numWrites, 1)
+}
+
+// Removes e from the queue, returns false if it is not queued.
+// Called with qmu held.
+func (d *diskCache) dequeue(e *entry) bool {
+	if d.pending[e.key] != e {
+		return false
+	}
+	delete(d.pending, e.key)
+	return true
+}
+
+// Reads and removes a value. The caller puts the value back
+// in the processor cache.
+func (d *diskCache) get(key uint64) (Value, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, false
+	}
+	d.qmu.Lock()
+	e, queued := d.pending[key]
+	if queued {
+		delete(d.pending, key)
+	}
+	d.qmu.Unlock()
+	if queued {
+		d.remove(key) // an older value may be in the file.
+		if e.expired(time.Now()) {
+			return nil, false
+		}
+		atomic.AddUint64(&d.numHits, 1)
+		return e.value, true
+	}
+
+	de, ok := d.index[key]
+	if !ok {
+		return nil, false
+	}
+	d.remove(key)
+	if !de.expires.IsZero() && time.Now().After(de.expires) {
+		return nil, false
+	}
+	buf := make([]byte, de.length)
+	if _, err := d.f.ReadAt(buf, de.offset); err != nil {
+		glog.Errorf("can't read spill file %s: %s", d.f.Name(), err)
+		return nil, false
+	}
+	var v Value
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&v); err != nil {
+		glog.Errorf("can't decode spilled value for key %d: %s", key, err)
+		return nil, false
+	}
+	atomic.AddUint64(&d.numHits, 1)
+	return v, true
+}
+
+// Removes the keys in [start,end).
+func (d *diskCache) deleteRange(start, end uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for k := range d.index {
+		if k >= start && k < end {
+			d.remove(k)
+		}
+	}
+	d.qmu.Lock()
+	defer d.qmu.Unlock()
+	for k := range d.pending {
+		if k >= start && k < end {
+			delete(d.pending, k)
+		}
+	}
+}
+
+func (d *diskCache) clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.index = make(map[uint64]diskEntry)
+	d.live = 0
+	d.size = 0
+	d.qmu.Lock()
+	d.pending = make(map[uint64]*entry)
+	d.qmu.Unlock()
+	if d.closed {
+		return
+	}
+	if err := d.f.Truncate(0); err != nil {
+		glog.Errorf("can't truncate spill file %s: %s", d.f.Name(), err)
+	}
+}
+
+// Closes and deletes the file.
+func (d *diskCache) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	d.index = make(map[uint64]diskEntry)
+	d.live = 0
+	d.size = 0
+	d.qmu.Lock()
+	d.pending = make(map[uint64]*entry)
+	d.qmu.Unlock()
+	err := d.f.Close()
+	if e := os.Remove(d.f.Name()); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Returns the number of values, including the queued ones, and the
+// size of the file.
+func (d *diskCache) stats() (length int, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.qmu.Lock()
+	defer d.qmu.Unlock()
+
+	return len(d.index) + len(d.pending), d.size
+}
+
+func (d *diskCache) remove(key uint64) {
+	if de, ok := d.index[key]; ok {
+		delete(d.index, key)
+		d.live -= int64(de.length)
+	}
+}
+
+// Rewrites the live records dropping the oldest ones until the
+// file size is at most max.
+func (d *diskCache) compact(max int64) error {
+
+	type record struct {
+		key uint64
+		diskEntry
+	}
+	records := make([]record, 0, len(d.index))
+	for k, de := range d.index {
+		records = append(records, record{k, de})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].offset < records[j].offset })
+	live := d.live
+	for len(records) > 0 && live > max {
+		live -= int64(records[0].length)
+		delete(d.index, records[0].key)
+		records = records[1:]
+	}
+
+	// Move the records to the beginning of the file. Records only move
+	// towards the start so we can read and write in place.
+	var offset int64
+	for _, r := range records {
+		if r.offset != offset {
+			sr := io.NewSectionReader(d.f, r.offset, int64(r.length))
+			buf := make([]byte, r.length)
+			if _, err := io.ReadFull(sr, buf); err != nil {
+				return err
+			}
+			if _, err := d.f.WriteAt(buf, offset); err != nil {
+				return err
+			}
+		}
+		r.diskEntry.offset = offset
+		d.index[r.key] = r.diskEntry
+		offset += int64(r.length)
+	}
+	if err := d.f.Truncate(offset); err != nil {
+		return err
+	}
+	glog.V(3).Infof("compacted spill file %s from %d to %d bytes", d.f.Name(), d.size, offset)
+	d.size = offset
+	d.live = offset
+	return nil
+}
+
+// Adds a second level cache on the local disk that holds up to maxBytes of
+// values evicted from the processor cache. The file is created in App.SpillDir.
+// Values of untyped processors must be registered with gob. If the file can't
+// be created, the error is reported by Validate.
+func Spill(maxBytes uint64) ProcOption {
+	return func(ctx *Context) {
+		if ctx.spill != nil {
+			ctx.spill.close()
+			ctx.spill = nil
+			ctx.cache.SetEvict(nil)
+		}
+		d, err := newDiskCache(ctx.app.SpillDir, ctx, int64(maxBytes))
+		if err != nil {
+			ctx.optErrs = append(ctx.optErrs, fmt.Errorf("can't create spill file: %w", err))
+			return
+		}
+		ctx.spill = d
+		ctx.cache.SetEvict(d.put)
+	}
+}
+
+// Writes the values evicted from the cache to the spill file. Called after
+// updating the cache.
+func (ctx *Context) flushSpill() {
+	if ctx.spill != nil {
+		ctx.spill.flush()
+	}
+}
+
+// Deletes the spill files.
+func (app *App) closeSpills() {
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		if ctx.spill == nil {
+			continue
+		}
+		if err := ctx.spill.close(); err != nil {
+			glog.Errorf("can't remove spill file for proc %d: %s", id, err)
+		}
+	}
+}
@@ -1,22 +1,59 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
 package occult
 
 import (
+	"math"
 	"sync/atomic"
 	"time"
 )
 
+// Upper bounds of the latency histogram buckets. Requests slower than the
+// last bound are counted in an extra overflow bucket.
+var latencyBounds = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Counters for a processor instance. Safe for concurrent use.
 type stats struct {
-	numRequests  uint64
-	numCacheHits uint64
-	start        time.Time
+	numRequests    uint64
+	numCacheHits   uint64
+	numCacheMisses uint64
+	numLocal       uint64
+	numRemote      uint64
+	numErrors      uint64
+	numEndOfArray  uint64
+	numCapAdded    uint64
+	numCapRemoved  uint64
+	numInvalidated uint64
+	numPrefetched  uint64
+	numFailovers   uint64
+	latencyCounts  []uint64
+	latencySum     int64
+	start          time.Time
 }
 
 func newStats() *stats {
 	s := new(stats)
 	s.start = time.Now()
+	s.latencyCounts = make([]uint64, len(latencyBounds)+1)
 	return s
 }
 
+func (s *stats) addFailover() {
+	atomic.AddUint64(&s.numFailovers, 1)
+}
+
 func (s *stats) addRequest() {
 	atomic.AddUint64(&s.numRequests, 1)
 }
@@ -25,6 +62,173 @@ func (s *stats) addCacheHit() {
 	atomic.AddUint64(&s.numCacheHits, 1)
 }
 
-func startStats() {
+func (s *stats) addCacheMiss() {
+	atomic.AddUint64(&s.numCacheMisses, 1)
+}
+
+// Counts a value computed on this node.
+func (s *stats) addLocal() {
+	atomic.AddUint64(&s.numLocal, 1)
+}
+
+// Counts a block requested to a remote node.
+func (s *stats) addRemote() {
+	atomic.AddUint64(&s.numRemote, 1)
+}
+
+// Records the outcome of a request.
+func (s *stats) addResult(d time.Duration, err error) {
+	switch {
+	case err == ErrEndOfArray:
+		atomic.AddUint64(&s.numEndOfArray, 1)
+	case err != nil:
+		atomic.AddUint64(&s.numErrors, 1)
+	}
+	i := 0
+	for ; i < len(latencyBounds); i++ {
+		if d <= latencyBounds[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&s.latencyCounts[i], 1)
+	atomic.AddInt64(&s.latencySum, int64(d))
+}
+
+// Statistics for a processor instance. Use App.Stats() to get a snapshot.
+type ProcStats struct {
+	ID          int
+	Requests    uint64
+	CacheHits   uint64
+	CacheMisses uint64
+	// Values computed on this node.
+	Local uint64
+	// Blocks requested to remote nodes.
+	Remote uint64
+	// Calls that waited for an identical call in flight. (Local and remote.)
+	Coalesced uint64
+	// Failed requests, not including ErrEndOfArray.
+	Errors     uint64
+	EndOfArray uint64
+	CacheLen   uint64
+	CacheCap   uint64
+	// Estimated memory used by the cache and its limit, in bytes.
+	CacheBytes    uint64
+	CacheMaxBytes uint64
+	// Capacity moved to and from this cache by the capacity manager.
+	CapacityAdded   uint64
+	CapacityRemoved uint64
+	// Values removed from the cache by App.Invalidate.
+	Invalidated uint64
+	// Second level cache on disk. (See Spill.)
+	SpillHits   uint64
+	SpillWrites uint64
+	SpillLen    uint64
+	SpillBytes  uint64
+	// Values fetched ahead of the requests. (See Prefetch.)
+	Prefetched uint64
+	// Requests sent to another node or done locally because the
+	// routed node was unreachable.
+	Failovers uint64
+	Latency   Histogram
+	// Time since the processor was created.
+	Uptime time.Duration
+}
+
+// Fraction of requests served from the cache.
+func (ps ProcStats) HitRate() float64 {
+	if ps.Requests == 0 {
+		return 0
+	}
+	return float64(ps.CacheHits) / float64(ps.Requests)
+}
+
+// A latency histogram. Counts[i] is the number of requests with latency
+// less or equal than Bounds[i]. The last count has no upper bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Mean latency.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Returns the upper bound of the bucket that contains quantile q in [0,1].
+// Returns the last bound if q falls in the overflow bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var acc uint64
+	for i, c := range h.Counts {
+		acc += c
+		if acc >= rank {
+			if i < len(h.Bounds) {
+				return h.Bounds[i]
+			}
+			break
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Returns a snapshot of the stats for a processor.
+func (ctx *Context) Stats() ProcStats {
+	s := ctx.stats
+	ps := ProcStats{
+		ID:              ctx.id,
+		Requests:        atomic.LoadUint64(&s.numRequests),
+		CacheHits:       atomic.LoadUint64(&s.numCacheHits),
+		CacheMisses:     atomic.LoadUint64(&s.numCacheMisses),
+		Local:           atomic.LoadUint64(&s.numLocal),
+		Remote:          atomic.LoadUint64(&s.numRemote),
+		Errors:          atomic.LoadUint64(&s.numErrors),
+		EndOfArray:      atomic.LoadUint64(&s.numEndOfArray),
+		CapacityAdded:   atomic.LoadUint64(&s.numCapAdded),
+		CapacityRemoved: atomic.LoadUint64(&s.numCapRemoved),
+		Invalidated:     atomic.LoadUint64(&s.numInvalidated),
+		Prefetched:      atomic.LoadUint64(&s.numPrefetched),
+		Failovers:       atomic.LoadUint64(&s.numFailovers),
+		Uptime:          time.Since(s.start),
+	}
+	local, remote := ctx.Coalesced()
+	ps.Coalesced = local + remote
+	ps.CacheLen, ps.CacheCap, _ = ctx.cache.Stats()
+	ps.CacheBytes, ps.CacheMaxBytes = ctx.cache.Usage()
+	if d := ctx.spill; d != nil {
+		ps.SpillHits = atomic.LoadUint64(&d.numHits)
+		ps.SpillWrites = atomic.LoadUint64(&d.numWrites)
+		n, size := d.stats()
+		ps.SpillLen, ps.SpillBytes = uint64(n), uint64(size)
+	}
+	ps.Latency = Histogram{
+		Bounds: latencyBounds,
+		Counts: make([]uint64, len(s.latencyCounts)),
+		Sum:    time.Duration(atomic.LoadInt64(&s.latencySum)),
+	}
+	for i := range s.latencyCounts {
+		ps.Latency.Counts[i] = atomic.LoadUint64(&s.latencyCounts[i])
+		ps.Latency.Count += ps.Latency.Counts[i]
+	}
+	return ps
+}
 
+// Returns a snapshot of the stats for all the processors in the app,
+// indexed by processor id.
+func (app *App) Stats() map[int]ProcStats {
+	m := make(map[int]ProcStats, len(app.procs))
+	for id, ctx := range app.procs {
+		m[id] = ctx.Stats()
+	}
+	return m
 }
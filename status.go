@@ -0,0 +1,221 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Human-readable status and metrics pages served by every node
+// on the same listener as the RPC server.
+
+const (
+	StatusPath   = "/status"
+	MetricsPath  = "/metrics"
+	GraphPath    = "/graph"
+	GraphDOTPath = "/graph.dot"
+)
+
+// The content of the status page.
+type Status struct {
+	App    string `json:"app"`
+	NodeID int    `json:"node_id"`
+	Ready  bool   `json:"ready"`
+	// Hash of the processor graph.
+	Fingerprint string       `json:"fingerprint"`
+	Nodes       []NodeStatus `json:"nodes,omitempty"`
+	Procs       []ProcStatus `json:"procs"`
+}
+
+// A cluster node as seen by the local node.
+type NodeStatus struct {
+	ID    int    `json:"id"`
+	Addr  string `json:"addr"`
+	Local bool   `json:"local"`
+	// Liveness reported by the failure detector.
+	State string `json:"state"`
+}
+
+// A processor instance in the app graph.
+type ProcStatus struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Ids of the input processors. A processor that was not created by
+	// the app has id -1.
+	Inputs   []int  `json:"inputs"`
+	Source   bool   `json:"source"`
+	CacheLen uint64 `json:"cache_len"`
+	CacheCap uint64 `json:"cache_cap"`
+}
+
+// Registers the status and metrics handlers.
+func (app *App) handleStatus(mux *http.ServeMux) {
+	mux.HandleFunc(StatusPath, app.serveStatus)
+	mux.HandleFunc(MetricsPath, app.serveMetrics)
+	mux.HandleFunc(GraphPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		app.WriteJSON(w, true)
+	})
+	mux.HandleFunc(GraphDOTPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		app.WriteDOT(w, true)
+	})
+}
+
+// Returns the status of the local node.
+func (app *App) Status() *Status {
+	st := &Status{
+		App:         app.Name,
+		Ready:       app.Ready(),
+		Fingerprint: app.Fingerprint(),
+		Procs:       make([]ProcStatus, 0, len(app.procs)),
+	}
+	if app.cluster != nil {
+		st.NodeID = app.cluster.NodeID
+		for _, node := range app.cluster.Nodes {
+			st.Nodes = append(st.Nodes, NodeStatus{
+				ID:    node.ID,
+				Addr:  node.Addr,
+				Local: app.cluster.IsLocal(node.ID),
+				State: app.NodeState(node.ID).String(),
+			})
+		}
+	}
+	for _, id := range app.procIDs() {
+		ctx := app.procs[id]
+		ps := ProcStatus{
+			ID:     id,
+			Name:   ctx.name,
+			Inputs: ctx.inputIDs(),
+			Source: ctx.isSource,
+		}
+		ps.CacheLen, ps.CacheCap, _ = ctx.cache.Stats()
+		st.Procs = append(st.Procs, ps)
+	}
+	return st
+}
+
+func (app *App) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(app.Status()); err != nil {
+		glog.Errorf("can't write status: %s", err)
+	}
+}
+
+func (app *App) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	app.writeMetrics(w)
+}
+
+// Writes the per-processor stats using the Prometheus text format.
+func (app *App) writeMetrics(w io.Writer) {
+
+	var nodeID int
+	if app.cluster != nil {
+		nodeID = app.cluster.NodeID
+	}
+	ids := app.procIDs()
+	stats := app.Stats()
+	labels := func(id int) string {
+		return fmt.Sprintf("app=%q,node=\"%d\",proc=\"%d\"", app.Name, nodeID, id)
+	}
+	metric := func(name, typ, help string, value func(ps ProcStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, id := range ids {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, labels(id), value(stats[id]))
+		}
+	}
+
+	metric("occult_requests_total", "counter", "Number of requests.",
+		func(ps ProcStats) float64 { return float64(ps.Requests) })
+	metric("occult_cache_hits_total", "counter", "Number of requests served from the cache.",
+		func(ps ProcStats) float64 { return float64(ps.CacheHits) })
+	metric("occult_cache_misses_total", "counter", "Number of requests not found in the cache.",
+		func(ps ProcStats) float64 { return float64(ps.CacheMisses) })
+	metric("occult_local_total", "counter", "Number of values computed on this node.",
+		func(ps ProcStats) float64 { return float64(ps.Local) })
+	metric("occult_remote_total", "counter", "Number of blocks requested to remote nodes.",
+		func(ps ProcStats) float64 { return float64(ps.Remote) })
+	metric("occult_coalesced_total", "counter", "Number of calls coalesced with a call in flight.",
+		func(ps ProcStats) float64 { return float64(ps.Coalesced) })
+	metric("occult_errors_total", "counter", "Number of failed requests.",
+		func(ps ProcStats) float64 { return float64(ps.Errors) })
+	metric("occult_end_of_array_total", "counter", "Number of requests past the end of the array.",
+		func(ps ProcStats) float64 { return float64(ps.EndOfArray) })
+	metric("occult_cache_length", "gauge", "Number of items in the cache.",
+		func(ps ProcStats) float64 { return float64(ps.CacheLen) })
+	metric("occult_cache_capacity", "gauge", "Capacity of the cache.",
+		func(ps ProcStats) float64 { return float64(ps.CacheCap) })
+	metric("occult_cache_bytes", "gauge", "Estimated memory used by the cache in bytes.",
+		func(ps ProcStats) float64 { return float64(ps.CacheBytes) })
+	metric("occult_cache_max_bytes", "gauge", "Memory limit of the cache in bytes, zero means no limit.",
+		func(ps ProcStats) float64 { return float64(ps.CacheMaxBytes) })
+	metric("occult_capacity_added_total", "counter", "Cache capacity added by the capacity manager.",
+		func(ps ProcStats) float64 { return float64(ps.CapacityAdded) })
+	metric("occult_capacity_removed_total", "counter", "Cache capacity removed by the capacity manager.",
+		func(ps ProcStats) float64 { return float64(ps.CapacityRemoved) })
+	metric("occult_invalidated_total", "counter", "Number of values removed from the cache by invalidation.",
+		func(ps ProcStats) float64 { return float64(ps.Invalidated) })
+	metric("occult_spill_hits_total", "counter", "Number of values read from the spill file.",
+		func(ps ProcStats) float64 { return float64(ps.SpillHits) })
+	metric("occult_spill_writes_total", "counter", "Number of evicted values written to the spill file.",
+		func(ps ProcStats) float64 { return float64(ps.SpillWrites) })
+	metric("occult_prefetched_total", "counter", "Number of values fetched ahead of the requests.",
+		func(ps ProcStats) float64 { return float64(ps.Prefetched) })
+	metric("occult_failovers_total", "counter", "Requests rerouted because the routed node was unreachable.",
+		func(ps ProcStats) float64 { return float64(ps.Failovers) })
+	metric("occult_spill_bytes", "gauge", "Size of the spill file in bytes.",
+		func(ps ProcStats) float64 { return float64(ps.SpillBytes) })
+
+	name := "occult_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Request latency.\n# TYPE %s histogram\n", name, name)
+	for _, id := range ids {
+		h := stats[id].Latency
+		var acc uint64
+		for i, b := range h.Bounds {
+			acc += h.Counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%v\"} %d\n", name, labels(id), b.Seconds(), acc)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(id), h.Count)
+		fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels(id), h.Sum.Seconds())
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(id), h.Count)
+	}
+}
+
+// Returns the processor ids in ascending order.
+func (app *App) procIDs() []int {
+	ids := make([]int, 0, len(app.procs))
+	for id := range app.procs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Returns the ids of the input processors, -1 if the input was
+// not created by an App. Nil inputs are skipped.
+func (ctx *Context) inputIDs() []int {
+	ids := make([]int, 0, len(ctx.inputs))
+	for i, in := range ctx.inputs {
+		if in == nil {
+			continue
+		}
+		id := -1
+		if ic := ctx.inputCtxs[i]; ic != nil {
+			id = ic.id
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
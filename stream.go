@@ -0,0 +1,289 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Use as the end key to stream values until the processor
+// returns ErrEndOfArray.
+const NoEnd uint64 = math.MaxUint64
+
+// A key-value pair produced by a Stream.
+type Pair struct {
+	Key   uint64
+	Value Value
+}
+
+// A Stream delivers the values of a processor for a range of keys.
+// Receive from C until it is closed, then call Err to find out why
+// the stream ended.
+type Stream struct {
+	// Closed when the stream ends.
+	C <-chan Pair
+
+	err    error
+	cancel context.CancelFunc
+}
+
+// Returns the error that ended the stream. Returns nil if the stream
+// reached the end key or the processor returned ErrEndOfArray. Otherwise
+// the error is a *KeyError for the lowest failing key or the error of the
+// context.Context. Must be called after C is closed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Stops the stream. Values in flight are discarded.
+func (s *Stream) Close() {
+	s.cancel()
+	for range s.C {
+	}
+}
+
+// Stream applies the processor to the key range {start..end-1} and
+// delivers the values in key order. Use end=NoEnd to stream until
+// ErrEndOfArray. The keys are processed in blocks of App.BlockSize
+// using App.NumWorkers workers.
+func (p Processor) Stream(c context.Context, start, end uint64) *Stream {
+	return newStream(c, p, start, end, true, 0)
+}
+
+// Same as Stream but values are delivered as soon as they are ready,
+// not in key order. Values for keys beyond the key that ended the stream
+// may be delivered.
+func (p Processor) StreamUnordered(c context.Context, start, end uint64) *Stream {
+	return newStream(c, p, start, end, false, 0)
+}
+
+// MapAll applies the processor to the processor values
+// with key range {start..}. Values are delivered in no particular order.
+// Errors other than ErrEndOfArray are logged; use Stream to get them.
+func (p Processor) MapAll(start uint64, ctx *Context) chan Value {
+	return p.MapAllCtx(context.Background(), start, ctx)
+}
+
+// Same as MapAll but the workers stop when c is done. The channel is
+// closed when c is done, even if the values are not received.
+func (p Processor) MapAllCtx(c context.Context, start uint64, ctx *Context) chan Value {
+	out := make(chan Value, ctx.app.NumWorkers)
+	s := p.StreamUnordered(c, start, NoEnd)
+	go func() {
+		defer close(out)
+		for pair := range s.C {
+			select {
+			case out <- pair.Value:
+			case <-c.Done():
+				s.Close()
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			glog.Errorf("map all failed: %s", err)
+		}
+	}()
+	return out
+}
+
+// A result produced by a stream worker.
+type result struct {
+	key uint64
+	val Value
+	err error
+}
+
+// Provides keys to workers.
+type counter struct {
+	k    uint64
+	end  uint64
+	size uint64
+	// When window > 0, blocks are handed out only if they start
+	// before sent+window. Limits how far workers get ahead of the consumer.
+	window uint64
+	sent   uint64
+	stop   bool // set to stop handing out blocks
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+func newCounter(start, end, size, window uint64) *counter {
+	c := &counter{k: start, end: end, size: size, window: window, sent: start}
+	c.cond = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// Safely returns the start and end of the next block. Blocks while
+// the block is outside the window. Returns ok=false when there is no more work.
+func (c *counter) block() (start, end uint64, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	for !c.stop && c.window > 0 && c.k >= c.sent+c.window {
+		c.cond.Wait()
+	}
+	if c.stop || c.k >= c.end {
+		return 0, 0, false
+	}
+	start = c.k
+	c.k += c.size
+	if c.k < start || c.k > c.end { // overflow or past end
+		c.k = c.end
+	}
+	return start, c.k, true
+}
+
+// Moves the window forward.
+func (c *counter) advance(sent uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.sent = sent
+	c.cond.Broadcast()
+}
+
+// Stops handing out blocks.
+func (c *counter) halt() {
+	c.Lock()
+	defer c.Unlock()
+	c.stop = true
+	c.cond.Broadcast()
+}
+
+// Worker does work for block of keys obtained (safely) from counter.
+// Exits after the first error.
+func (c *counter) worker(cc context.Context, p CtxProcessor, results chan result) {
+	for {
+		start, end, ok := c.block()
+		if !ok {
+			return
+		}
+		for key := start; key < end; key++ {
+			v, err := p(cc, key)
+			results <- result{key: key, val: v, err: err}
+			if err != nil {
+				glog.V(4).Infof("worker exiting with err: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// Creates a stream. When ordered, workers stay within window keys of
+// the last key sent. If window is zero, uses a default window.
+func newStream(c context.Context, p Processor, start, end uint64, ordered bool, window uint64) *Stream {
+
+	numWorkers, size := 1, DefaultBlockSize
+	if ctx := lookup(p); ctx != nil {
+		numWorkers, size = ctx.app.NumWorkers, ctx.app.BlockSize
+	}
+	if !ordered {
+		window = 0
+	} else if window == 0 {
+		window = defaultWindow(numWorkers, size)
+	}
+	c, cancel := context.WithCancel(c)
+	out := make(chan Pair, numWorkers)
+	s := &Stream{C: out, cancel: cancel}
+	cnt := newCounter(start, end, size, window)
+	go s.master(c, p.Ctx(), cnt, numWorkers, ordered, out)
+	return s
+}
+
+// Enough keys for every worker to be one block ahead.
+func defaultWindow(numWorkers int, size uint64) uint64 {
+	return 2 * uint64(numWorkers) * size
+}
+
+// Coordinate workers.
+// TODO: num workers for local vs. remote work is the same.
+// We need separate params because local depends on the number of cores
+// and remote depends on the network topology. To do this we will
+// need to determine local vs. remote upstream instead of downstream
+// from here.
+func (s *Stream) master(c context.Context, p CtxProcessor, cnt *counter, numWorkers int, ordered bool, out chan Pair) {
+
+	defer close(out)
+	defer s.cancel()
+	defer cnt.halt()
+
+	// Next key to send when ordered.
+	next := cnt.k
+
+	results := make(chan result, numWorkers*int(cnt.size))
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cnt.worker(c, p, results)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// The lowest key that ended the stream and its error.
+	term := cnt.end
+	var termErr error
+
+	// Values waiting for lower keys when ordered.
+	pending := make(map[uint64]Value)
+
+	send := func(key uint64, v Value) bool {
+		select {
+		case out <- Pair{Key: key, Value: v}:
+			return true
+		case <-c.Done():
+			return false
+		}
+	}
+
+	cancelled := false
+	for r := range results {
+		if cancelled {
+			continue // drain
+		}
+		switch {
+		case r.err != nil:
+			if r.key < term {
+				term, termErr = r.key, r.err
+			}
+			cnt.halt()
+		case !ordered:
+			cancelled = !send(r.key, r.val)
+		case r.key < term:
+			pending[r.key] = r.val
+		}
+		for ordered && !cancelled && next < term {
+			v, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			cancelled = !send(next, v)
+			next++
+			cnt.advance(next)
+		}
+		if cancelled {
+			cnt.halt()
+		}
+	}
+
+	switch {
+	case cancelled || isContextErr(termErr):
+		s.err = c.Err()
+		if s.err == nil {
+			s.err = termErr
+		}
+	case termErr != nil && termErr != ErrEndOfArray:
+		s.err = &KeyError{Key: term, Err: termErr}
+	}
+	glog.V(4).Infof("stream closing, err: %v", s.err)
+}
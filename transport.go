@@ -0,0 +1,224 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Transport carries the requests between the nodes of a cluster. Select
+// a transport by name using the transport field of the cluster config:
+//
+//	cluster:
+//	  transport: chan
+//
+// Available transports are "rpc" (net/rpc over HTTP using GOB, the default)
+// and "chan" (in-process, for running several nodes in one process).
+// Use RegisterTransport to add transports.
+type Transport interface {
+	// Starts serving requests for the local node on addr using rp.
+	// Returns once the server is listening.
+	Serve(addr string, rp *RProc) error
+	// Connects to the node that serves on addr.
+	Dial(addr string) (Conn, error)
+	// Stops serving requests.
+	Close() error
+}
+
+// A connection to a remote node. Calls block until the remote node
+// replies. Errors returned by the remote node are *RemoteError, other
+// errors mean the node could not be reached. Must be safe for
+// concurrent use.
+type Conn interface {
+	// Gets the values for a key range. (See RProc.Get.)
+	Get(args *RArgs) (*RSlice, error)
+	// Gets the values for several key ranges. (See RProc.GetMulti.)
+	GetMulti(args *RMultiArgs) (*RMultiReply, error)
+	// Agrees on the encoding of the values sent by the remote node.
+	// Returns nil if the values don't need to be encoded. (See Codec.)
+	Negotiate(offer *Encoding) (*Encoding, error)
+	// Returns true if the remote node is ready to take requests.
+	Ready() (bool, error)
+	// Returns the graph fingerprint of the remote node.
+	Fingerprint() (string, error)
+	// Invalidates keys on the remote node. (See App.Invalidate.)
+	Invalidate(args *RArgs) error
+	// Asks the remote node to terminate.
+	Shutdown() error
+	Close() error
+}
+
+// The default transport.
+const DefaultTransport = "rpc"
+
+var transports = struct {
+	sync.Mutex
+	m map[string]func() Transport
+}{m: map[string]func() Transport{
+	"rpc":  func() Transport { return &rpcTransport{} },
+	"chan": func() Transport { return &chanTransport{} },
+}}
+
+// Makes a transport available by name. The function is called once
+// for each App that uses the transport.
+func RegisterTransport(name string, fn func() Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+	transports.m[name] = fn
+}
+
+// Creates a transport by name. An empty name means DefaultTransport.
+func newTransport(name string) (Transport, error) {
+	if name == "" {
+		name = DefaultTransport
+	}
+	transports.Lock()
+	defer transports.Unlock()
+	fn, ok := transports.m[name]
+	if !ok {
+		names := make([]string, 0, len(transports.m))
+		for n := range transports.m {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown transport %q, available: %v", name, names)
+	}
+	return fn(), nil
+}
+
+// Uses net/rpc over HTTP. Each App has its own rpc.Server and serve mux
+// which also serves the status pages. Values are encoded using GOB so
+// custom types must be registered with gob.Register.
+type rpcTransport struct {
+	l net.Listener
+}
+
+func (t *rpcTransport) Serve(addr string, rp *RProc) error {
+	srv := rpc.NewServer()
+	if err := srv.Register(rp); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, srv)
+	rp.app.handleStatus(mux)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen error: %s", err)
+	}
+	t.l = l
+	go http.Serve(l, mux)
+	return nil
+}
+
+// Max time to connect to a node, including the HTTP handshake.
+const dialTimeout = 10 * time.Second
+
+// Same as rpc.DialHTTP but gives up after dialTimeout so a hung
+// node doesn't block the caller.
+func (t *rpcTransport) Dial(addr string) (Conn, error) {
+	client, err := dialHTTP(addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing error: %s", err)
+	}
+	return &rpcConn{client}, nil
+}
+
+func dialHTTP(addr string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+func (t *rpcTransport) Close() error {
+	if t.l == nil {
+		return nil
+	}
+	return t.l.Close()
+}
+
+type rpcConn struct {
+	client *rpc.Client
+}
+
+// Calls a method, errors returned by the remote node are *RemoteError.
+func (c *rpcConn) call(method string, args, reply any) error {
+	err := c.client.Call(method, args, reply)
+	var se rpc.ServerError
+	if errors.As(err, &se) {
+		return &RemoteError{Msg: string(se)}
+	}
+	return err
+}
+
+func (c *rpcConn) Get(args *RArgs) (*RSlice, error) {
+	var reply RSlice
+	if err := c.call("RProc.Get", args, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (c *rpcConn) GetMulti(args *RMultiArgs) (*RMultiReply, error) {
+	var reply RMultiReply
+	if err := c.call("RProc.GetMulti", args, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (c *rpcConn) Negotiate(offer *Encoding) (*Encoding, error) {
+	var reply Encoding
+	if err := c.call("RProc.Negotiate", offer, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (c *rpcConn) Ready() (ready bool, err error) {
+	err = c.call("RProc.Ready", 0, &ready)
+	return
+}
+
+func (c *rpcConn) Fingerprint() (fp string, err error) {
+	err = c.call("RProc.Fingerprint", 0, &fp)
+	return
+}
+
+func (c *rpcConn) Invalidate(args *RArgs) error {
+	var reply bool
+	return c.call("RProc.Invalidate", args, &reply)
+}
+
+func (c *rpcConn) Shutdown() error {
+	var reply bool
+	return c.call("RProc.Shutdown", 0, &reply)
+}
+
+func (c *rpcConn) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2014 AKUALAB INC., All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package occult
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+// Typed processors check the wiring of the graph when it is built instead of
+// panicking on a type assertion at run time. They run on the same App machinery
+// as untyped processors: the values are cached and sent to remote nodes as Values.
+//
+// Example:
+//
+//	ints := occult.AddTypedSource(app, randomFunc, opt)
+//	windows := occult.AddTyped(app, windowFunc, opt, ints)
+//	w, err := windows.Get(3) // w has type []int
+//
+// where randomFunc has type func(context.Context, uint64, *Context) (int, error)
+// and windowFunc has type
+// func(context.Context, uint64, *Context, TypedProcessor[int]) ([]int, error).
+// As with a CtxProcFunc, pass the context.Context to the inputs using
+// TypedProcessor.Call to propagate the deadline and cancellation.
+
+// A Processor whose values have type T.
+type TypedProcessor[T any] struct {
+	Processor
+	cproc CtxProcessor // resolved once, see Processor.Ctx
+}
+
+// Returns the value for key.
+func (p TypedProcessor[T]) Get(key uint64) (T, error) {
+	return p.Call(context.Background(), key)
+}
+
+// Same as Get using a context.Context. (See Processor.Call.)
+func (p TypedProcessor[T]) Call(c context.Context, key uint64) (T, error) {
+	cproc := p.cproc
+	if cproc == nil {
+		cproc = p.Processor.Ctx()
+	}
+	v, err := cproc(c, key)
+	return assertValue[T](key, v, err)
+}
+
+// Converts a Processor to a TypedProcessor. Returns an error if p
+// was created using the typed API with a type that is not assignable to T.
+// Values of untyped processors are checked when they are retrieved.
+func Typed[T any](p Processor) (TypedProcessor[T], error) {
+	want := typeOf[T]()
+	if ctx := lookup(p); ctx != nil && ctx.outType != nil && !ctx.outType.AssignableTo(want) {
+		return TypedProcessor[T]{}, fmt.Errorf("processor %d has type %s, want %s", ctx.id, ctx.outType, want)
+	}
+	return TypedProcessor[T]{Processor: p, cproc: p.Ctx()}, nil
+}
+
+// Adds a typed source processor to the app.
+func AddTypedSource[Out any](app *App, fn func(c context.Context, key uint64, ctx *Context) (Out, error),
+	opt interface{}) TypedProcessor[Out] {
+
+	p := app.AddSourceCtx(func(c context.Context, key uint64, ctx *Context) (Value, error) {
+		return fn(c, key, ctx)
+	}, opt)
+	lookup(p).funcName = funcName(fn)
+	return typedProcessor[Out](p)
+}
+
+// Adds a typed processor with one input to the app.
+func AddTyped[In, Out any](app *App, fn func(c context.Context, key uint64, ctx *Context, in TypedProcessor[In]) (Out, error),
+	opt interface{}, in TypedProcessor[In]) TypedProcessor[Out] {
+
+	p := app.AddCtx(func(c context.Context, key uint64, ctx *Context) (Value, error) {
+		return fn(c, key, ctx, in)
+	}, opt, in.Processor)
+	lookup(p).funcName = funcName(fn)
+	return typedProcessor[Out](p)
+}
+
+// Adds a typed processor with two inputs to the app.
+func AddTyped2[In1, In2, Out any](app *App,
+	fn func(c context.Context, key uint64, ctx *Context, in1 TypedProcessor[In1], in2 TypedProcessor[In2]) (Out, error),
+	opt interface{}, in1 TypedProcessor[In1], in2 TypedProcessor[In2]) TypedProcessor[Out] {
+
+	p := app.AddCtx(func(c context.Context, key uint64, ctx *Context) (Value, error) {
+		return fn(c, key, ctx, in1, in2)
+	}, opt, in1.Processor, in2.Processor)
+	lookup(p).funcName = funcName(fn)
+	return typedProcessor[Out](p)
+}
+
+// Records the output type and registers it with gob so values
+// can be sent to remote nodes.
+func typedProcessor[Out any](p Processor) TypedProcessor[Out] {
+	t := typeOf[Out]()
+	ctx := lookup(p)
+	ctx.outType = t
+	if t.Kind() != reflect.Interface {
+		var zero Out
+		gob.Register(zero)
+	}
+	return TypedProcessor[Out]{Processor: p, cproc: ctx.cproc}
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// Asserts that v has type T. Returns an error instead of panicking.
+func assertValue[T any](key uint64, v Value, err error) (T, error) {
+	var zero T
+	if v == nil {
+		return zero, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, &KeyError{Key: key, Err: fmt.Errorf("value has type %T, want %s", v, typeOf[T]())}
+	}
+	return t, err
+}